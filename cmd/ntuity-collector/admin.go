@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// secretFlags are the flags whose values are redacted in the effective
+// configuration.
+var secretFlags = map[string]bool{
+	"sentry-dsn":    true,
+	"heartbeat-url": true,
+}
+
+func registerAdminHandlers(config *configStore, paused *pausedSites, audit *auditLog) {
+	http.HandleFunc("/api/v1/admin/pause", audit.handler("pause", requireAdmin(pauseHandler(config, paused, true))))
+	http.HandleFunc("/api/v1/admin/resume", audit.handler("resume", requireAdmin(pauseHandler(config, paused, false))))
+	http.HandleFunc("/api/v1/config", audit.handler("config", requireAdmin(configHandler(config))))
+}
+
+// adminPassword returns the password of the admin user, which is taken from
+// the environment like the API key.
+func adminPassword() string {
+	return os.Getenv("NTUITY_ADMIN_PASSWORD")
+}
+
+// requireAdmin only passes on requests authenticated as the admin user.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		password := adminPassword()
+		username, given, ok := r.BasicAuth()
+		if !ok || len(password) == 0 || !equalSecret(username, *adminUsername) || !equalSecret(given, password) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", "admin"))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		setAuditUser(r, username)
+		h(w, r)
+	}
+}
+
+func equalSecret(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// configHandler returns the effective configuration, i.e. the flags and the
+// configuration after substituting environment variables and reloads, with
+// all secrets redacted.
+func configHandler(config *configStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		flags := make(map[string]string)
+		flag.VisitAll(func(f *flag.Flag) {
+			value := f.Value.String()
+			if secretFlags[f.Name] {
+				value = redact(value)
+			}
+			flags[f.Name] = value
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Flags  map[string]string `json:"flags"`
+			Config *Config           `json:"config"`
+		}{
+			Flags:  flags,
+			Config: config.get().redacted(),
+		})
+	}
+}
+
+// pauseHandler pauses or resumes polling for the site given by the "site"
+// query parameter.
+func pauseHandler(config *configStore, paused *pausedSites, pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		site := r.URL.Query().Get("site")
+		if !config.get().hasSite(site) {
+			http.Error(w, fmt.Sprintf("Unknown site %q", site), http.StatusNotFound)
+			return
+		}
+
+		paused.setPaused(site, pause)
+
+		if pause {
+			logInfo("Paused polling for site %s", site)
+		} else {
+			logInfo("Resumed polling for site %s", site)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// registerLifecycleHandlers registers the /-/reload and /-/quit endpoints
+// known from Prometheus.
+func registerLifecycleHandlers(config *configStore, requestQuit func(), audit *auditLog) {
+	http.HandleFunc("/-/reload", audit.handler("reload", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		old := config.get()
+		if err := config.reload(); err != nil {
+			logError("Failed to reload configuration: %v", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		logInfo("Reloaded configuration")
+
+		if rotated := rotatedAPIKeys(old, config.get()); len(rotated) > 0 {
+			e := requestEntry("rotate_api_keys", r)
+			e.Outcome = "success"
+			e.Details = rotated
+			audit.record(e)
+		}
+	})))
+
+	http.HandleFunc("/-/quit", audit.handler("quit", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fmt.Fprintf(w, "Requesting termination... Goodbye!")
+		requestQuit()
+	})))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// countRedacted returns the number of redacted values in a decoded JSON
+// document.
+func countRedacted(v interface{}) int {
+	switch v := v.(type) {
+	case string:
+		if v == redactedSecret {
+			return 1
+		}
+	case []interface{}:
+		n := 0
+		for _, e := range v {
+			n += countRedacted(e)
+		}
+		return n
+	case map[string]interface{}:
+		n := 0
+		for _, e := range v {
+			n += countRedacted(e)
+		}
+		return n
+	}
+	return 0
+}
+
+func TestConfigHandlerRedactsSecrets(t *testing.T) {
+	os.Setenv("NTUITY_ADMIN_PASSWORD", "admin-password")
+	defer os.Unsetenv("NTUITY_ADMIN_PASSWORD")
+
+	for name, value := range map[string]string{
+		"sentry-dsn":    "https://hunter2-dsn@sentry.example.com/1",
+		"heartbeat-url": "https://hc-ping.com/hunter2-uuid",
+	} {
+		previous := flag.Lookup(name).Value.String()
+		flag.Set(name, value)
+		defer flag.Set(name, previous)
+	}
+
+	config := newConfigStore(&Config{
+		APIKey: "hunter2-api-key",
+		Sites: []SiteConfig{
+			{ID: "a"},
+			{ID: "b", APIKey: "hunter2-site-api-key"},
+		},
+		Outputs: []OutputConfig{
+			{Name: "heater", Site: "a", Shelly: &ShellyConfig{Address: "192.0.2.1", Username: "admin", Password: "hunter2-shelly"}},
+			{Name: "pump", Site: "a", Tasmota: &TasmotaConfig{Address: "192.0.2.2", Username: "admin", Password: "hunter2-tasmota"}},
+		},
+		Tenants: []TenantConfig{
+			{Name: "acme", Username: "acme", Password: "hunter2-tenant"},
+		},
+	})
+	handler := requireAdmin(configHandler(config))
+
+	req := httptest.NewRequest("GET", "/api/v1/config", nil)
+	req.SetBasicAuth("admin", "admin-password")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, "hunter2") {
+		t.Errorf("secret in effective configuration: %s", body)
+	}
+	// The api key, the one of site b, the passwords of the relays and the
+	// tenant and both flags.
+	var effective interface{}
+	if err := json.Unmarshal([]byte(body), &effective); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRedacted(effective); n != 7 {
+		t.Errorf("%d redacted values, want 7: %s", n, body)
+	}
+	// Redacting works on a copy.
+	if config.get().Tenants[0].Password != "hunter2-tenant" {
+		t.Errorf("configuration changed by redacting it")
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, c := range []struct {
+		name     string
+		password string
+		auth     bool
+		username string
+		given    string
+		want     int
+	}{
+		{"valid credentials", "admin-password", true, "admin", "admin-password", http.StatusNoContent},
+		{"no credentials", "admin-password", false, "", "", http.StatusUnauthorized},
+		{"wrong password", "admin-password", true, "admin", "wrong", http.StatusUnauthorized},
+		{"wrong user", "admin-password", true, "root", "admin-password", http.StatusUnauthorized},
+		{"no password configured", "", true, "admin", "", http.StatusUnauthorized},
+	} {
+		os.Setenv("NTUITY_ADMIN_PASSWORD", c.password)
+
+		req := httptest.NewRequest("GET", "/api/v1/config", nil)
+		if c.auth {
+			req.SetBasicAuth(c.username, c.given)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		if rec.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", c.name, rec.Code, c.want)
+		}
+		if c.want == http.StatusUnauthorized && len(rec.Header().Get("WWW-Authenticate")) == 0 {
+			t.Errorf("%s: no WWW-Authenticate header", c.name)
+		}
+	}
+	os.Unsetenv("NTUITY_ADMIN_PASSWORD")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Client identifies who triggered the action: the remote address of the
+	// request, or the signal received. User is the user the request was
+	// authenticated as with the admin credentials. ForwardedFor is the
+	// X-Forwarded-For header of the request, which any client can set.
+	Client       string `json:"client"`
+	User         string `json:"user,omitempty"`
+	ForwardedFor string `json:"forwarded_for_unverified,omitempty"`
+	Site         string `json:"site,omitempty"`
+	Outcome      string `json:"outcome"`
+	Status       int    `json:"status,omitempty"`
+	// Details holds further information like the sites whose API key was
+	// rotated. It never contains secrets.
+	Details []string `json:"details,omitempty"`
+}
+
+// auditLog appends an entry for every administrative action to a file. A nil
+// auditLog doesn't record anything.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{file: f}, nil
+}
+
+// record appends the entry and syncs it to disk, so that no entry is lost on
+// a crash right after the action.
+func (a *auditLog) record(e auditEntry) {
+	if a == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	bs, err := json.Marshal(e)
+	if err != nil {
+		logError("Failed to write audit log: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.file.Write(append(bs, '\n')); err != nil {
+		logError("Failed to write audit log: %v", err)
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		logError("Failed to write audit log: %v", err)
+	}
+}
+
+// auditUserKey is the context key of the user a request was authenticated as.
+type auditUserKey struct{}
+
+// setAuditUser records the user the request was authenticated as in the
+// entry of the request.
+func setAuditUser(r *http.Request, user string) {
+	if p, ok := r.Context().Value(auditUserKey{}).(*string); ok {
+		*p = user
+	}
+}
+
+// requestEntry returns an entry for the action requested by r.
+func requestEntry(action string, r *http.Request) auditEntry {
+	e := auditEntry{
+		Action:       action,
+		Client:       r.RemoteAddr,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Site:         r.URL.Query().Get("site"),
+	}
+	if p, ok := r.Context().Value(auditUserKey{}).(*string); ok {
+		e.User = *p
+	}
+	return e
+}
+
+// statusRecorder records the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(bs []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(bs)
+}
+
+// handler records every call of h, considering responses with an error
+// status failures.
+func (a *auditLog) handler(action string, h http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), auditUserKey{}, new(string)))
+		h(rec, r)
+
+		e := requestEntry(action, r)
+		e.Status = rec.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		e.Outcome = "success"
+		if e.Status >= http.StatusBadRequest {
+			e.Outcome = "failure"
+		}
+		a.record(e)
+	}
+}
+
+// rotatedAPIKeys returns the sites whose API key changed between two
+// configurations, including the global one as "*".
+func rotatedAPIKeys(old, cfg *Config) []string {
+	var rotated []string
+	if old.APIKey != cfg.APIKey {
+		rotated = append(rotated, "*")
+	}
+	for _, site := range cfg.Sites {
+		if oldSite, ok := old.site(site.ID); ok && old.apiKey(oldSite) != cfg.apiKey(site) {
+			rotated = append(rotated, site.ID)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated
+}
+
+// changedSites returns the sites added and removed between two
+// configurations.
+func changedSites(old, cfg *Config) (added, removed []string) {
+	for _, site := range cfg.Sites {
+		if !old.hasSite(site.ID) {
+			added = append(added, site.ID)
+		}
+	}
+	for _, site := range old.Sites {
+		if !cfg.hasSite(site.ID) {
+			removed = append(removed, site.ID)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
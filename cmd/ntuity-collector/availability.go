@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiAvailability tracks the availability of the ntuity API endpoints.
+var apiAvailability = newAvailabilityTracker()
+
+// endpointAvailability holds the availability record of an API endpoint. An
+// endpoint is considered down from its first failed request until the next
+// successful one.
+type endpointAvailability struct {
+	Requests            float64   `json:"requests"`
+	Failures            float64   `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	DowntimeSeconds     float64   `json:"downtime_seconds"`
+	DownSince           time.Time `json:"down_since,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+}
+
+// availabilityTracker records the outcome of every request to the API to
+// keep a record of the reliability of the ntuity cloud.
+type availabilityTracker struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointAvailability
+
+	requestsDesc         *prometheus.Desc
+	failuresDesc         *prometheus.Desc
+	consecutiveDesc      *prometheus.Desc
+	downtimeDesc         *prometheus.Desc
+	lastFailureDesc      *prometheus.Desc
+	sinceLastFailureDesc *prometheus.Desc
+}
+
+func newAvailabilityTracker() *availabilityTracker {
+	return &availabilityTracker{
+		endpoints: make(map[string]*endpointAvailability),
+		requestsDesc: prometheus.NewDesc(
+			"ntuity_api_requests_total",
+			"Number of requests to the API endpoint",
+			[]string{"endpoint"}, nil,
+		),
+		failuresDesc: prometheus.NewDesc(
+			"ntuity_api_failures_total",
+			"Number of requests to the API endpoint which failed or returned a server error",
+			[]string{"endpoint"}, nil,
+		),
+		consecutiveDesc: prometheus.NewDesc(
+			"ntuity_api_consecutive_failures",
+			"Number of failed requests to the API endpoint since the last successful one",
+			[]string{"endpoint"}, nil,
+		),
+		downtimeDesc: prometheus.NewDesc(
+			"ntuity_api_downtime_seconds_total",
+			"Time in seconds from failed requests to the API endpoint until the next successful one",
+			[]string{"endpoint"}, nil,
+		),
+		lastFailureDesc: prometheus.NewDesc(
+			"ntuity_api_last_failure_timestamp_seconds",
+			"Time of the last failed request to the API endpoint",
+			[]string{"endpoint"}, nil,
+		),
+		sinceLastFailureDesc: prometheus.NewDesc(
+			"ntuity_api_seconds_since_last_failure",
+			"Time in seconds since the last failed request to the API endpoint",
+			[]string{"endpoint"}, nil,
+		),
+	}
+}
+
+func (t *availabilityTracker) record(endpoint string, success bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.endpoints[endpoint]
+	if !ok {
+		e = &endpointAvailability{}
+		t.endpoints[endpoint] = e
+	}
+
+	now := time.Now()
+	e.Requests++
+
+	if success {
+		if !e.DownSince.IsZero() {
+			e.DowntimeSeconds += now.Sub(e.DownSince).Seconds()
+			e.DownSince = time.Time{}
+		}
+		e.ConsecutiveFailures = 0
+		return
+	}
+
+	e.Failures++
+	e.ConsecutiveFailures++
+	e.LastFailure = now
+	if e.DownSince.IsZero() {
+		e.DownSince = now
+	}
+}
+
+func (t *availabilityTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.requestsDesc
+	ch <- t.failuresDesc
+	ch <- t.consecutiveDesc
+	ch <- t.downtimeDesc
+	ch <- t.lastFailureDesc
+	ch <- t.sinceLastFailureDesc
+}
+
+func (t *availabilityTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for endpoint, e := range t.endpoints {
+		downtime := e.DowntimeSeconds
+		if !e.DownSince.IsZero() {
+			downtime += now.Sub(e.DownSince).Seconds()
+		}
+
+		ch <- prometheus.MustNewConstMetric(t.requestsDesc, prometheus.CounterValue, e.Requests, endpoint)
+		ch <- prometheus.MustNewConstMetric(t.failuresDesc, prometheus.CounterValue, e.Failures, endpoint)
+		ch <- prometheus.MustNewConstMetric(t.consecutiveDesc, prometheus.GaugeValue, float64(e.ConsecutiveFailures), endpoint)
+		ch <- prometheus.MustNewConstMetric(t.downtimeDesc, prometheus.CounterValue, downtime, endpoint)
+
+		if !e.LastFailure.IsZero() {
+			ch <- prometheus.MustNewConstMetric(t.lastFailureDesc, prometheus.GaugeValue, float64(e.LastFailure.Unix()), endpoint)
+			ch <- prometheus.MustNewConstMetric(t.sinceLastFailureDesc, prometheus.GaugeValue, now.Sub(e.LastFailure).Seconds(), endpoint)
+		}
+	}
+}
+
+func (t *availabilityTracker) saveState(s *state) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.APIAvailability = make(map[string]*endpointAvailability)
+	for endpoint, e := range t.endpoints {
+		copied := *e
+		s.APIAvailability[endpoint] = &copied
+	}
+}
+
+// restoreState restores the availability record. An endpoint which was down
+// when the collector stopped isn't accounted as down while it wasn't running.
+func (t *availabilityTracker) restoreState(s *state) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for endpoint, e := range s.APIAvailability {
+		e.DownSince = time.Time{}
+		t.endpoints[endpoint] = e
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// hoursPerWeek is the number of hour-of-week slots of a baseline.
+	hoursPerWeek = 7 * 24
+
+	// baselineWeight is the weight of a new hour in the exponentially
+	// weighted moving average of its slot. It's chosen so that the baseline
+	// mostly reflects the last couple of weeks.
+	baselineWeight = 0.25
+
+	// minBaselineWeeks is the number of weeks a slot has to be learned in
+	// before deviations from it are exported.
+	minBaselineWeeks = 3
+
+	// minBaselineCoverage is the share of an hour which has to be covered by
+	// samples for it to be learned.
+	minBaselineCoverage = 0.75
+)
+
+// baselineSlot holds the learned average consumption in W of an hour of the
+// week.
+type baselineSlot struct {
+	Power float64 `json:"power"`
+	Hours int     `json:"hours"`
+}
+
+func (s *baselineSlot) learn(power float64) {
+	if s.Hours == 0 {
+		s.Power = power
+	} else {
+		s.Power += baselineWeight * (power - s.Power)
+	}
+	s.Hours++
+}
+
+// siteBaseline holds the consumption baseline of a site and the consumption
+// integrated in the current hour.
+type siteBaseline struct {
+	powerIntegrator
+	Slots []baselineSlot `json:"slots"`
+
+	Hour        string  `json:"hour"`
+	HourSlot    int     `json:"hour_slot"`
+	HourEnergy  float64 `json:"hour_energy"`
+	HourSeconds float64 `json:"hour_seconds"`
+}
+
+// hourOfWeek returns the slot of the given time, counting the hours in its
+// location from Sunday midnight.
+func hourOfWeek(t time.Time) (string, int) {
+	return t.Format("2006-01-02T15"), int(t.Weekday())*24 + t.Hour()
+}
+
+// finishHour learns the average consumption of the current hour if it's
+// sufficiently covered by samples.
+func (b *siteBaseline) finishHour() {
+	if b.HourSeconds >= minBaselineCoverage*time.Hour.Seconds() {
+		b.Slots[b.HourSlot].learn(b.HourEnergy / (b.HourSeconds / time.Hour.Seconds()))
+	}
+	b.HourEnergy = 0
+	b.HourSeconds = 0
+}
+
+// consumptionBaseline learns the average consumption of each site per hour of
+// the week and exports how much the current consumption deviates from it.
+type consumptionBaseline struct {
+	mu     sync.Mutex
+	sites  map[string]*siteBaseline
+	config *configStore
+
+	baseline       *prometheus.GaugeVec
+	deviation      *prometheus.GaugeVec
+	deviationRatio *prometheus.GaugeVec
+}
+
+func newConsumptionBaseline(reg *prometheus.Registry, config *configStore) *consumptionBaseline {
+	c := &consumptionBaseline{
+		sites:  make(map[string]*siteBaseline),
+		config: config,
+		baseline: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "consumption_baseline_watts",
+				Help:      "Learned average consumption in W of the current hour of the week",
+			},
+			[]string{"site"},
+		),
+		deviation: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "consumption_baseline_deviation_watts",
+				Help:      "Deviation in W of the current consumption from the baseline",
+			},
+			[]string{"site"},
+		),
+		deviationRatio: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "consumption_baseline_deviation_ratio",
+				Help:      "Deviation of the current consumption from the baseline relative to the baseline",
+			},
+			[]string{"site"},
+		),
+	}
+
+	reg.MustRegister(c.baseline, c.deviation, c.deviationRatio)
+
+	config.onRemoveSite(func(site string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.sites, site)
+		c.delete(site)
+	})
+
+	return c
+}
+
+func (c *consumptionBaseline) delete(site string) {
+	c.baseline.DeleteLabelValues(site)
+	c.deviation.DeleteLabelValues(site)
+	c.deviationRatio.DeleteLabelValues(site)
+}
+
+func (c *consumptionBaseline) observe(site string, flow *EnergyFlow) {
+	t := flow.timestamp()
+	power := flowPowers(flow)["consumption"]
+	loc := c.config.get().siteLocation(site)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.sites[site]
+	if !ok {
+		s = &siteBaseline{Slots: make([]baselineSlot, hoursPerWeek)}
+		c.sites[site] = s
+	}
+
+	// The energy since the previous sample is accounted to the hour it was
+	// taken in.
+	hour, slot := hourOfWeek(s.LastTime.In(loc))
+	dt := t.Sub(s.LastTime)
+
+	energy, fresh := s.step(t, map[string]float64{"consumption": power})
+	if !fresh {
+		return
+	}
+
+	if energy != nil {
+		if hour != s.Hour {
+			if len(s.Hour) > 0 {
+				s.finishHour()
+			}
+			s.Hour = hour
+			s.HourSlot = slot
+		}
+		s.HourEnergy += energy["consumption"]
+		s.HourSeconds += dt.Seconds()
+	}
+
+	_, slot = hourOfWeek(t.In(loc))
+	learned := s.Slots[slot]
+	if learned.Hours < minBaselineWeeks {
+		c.delete(site)
+		return
+	}
+
+	c.baseline.WithLabelValues(site).Set(learned.Power)
+	c.deviation.WithLabelValues(site).Set(power - learned.Power)
+	if learned.Power > 0 {
+		c.deviationRatio.WithLabelValues(site).Set((power - learned.Power) / learned.Power)
+	} else {
+		c.deviationRatio.DeleteLabelValues(site)
+	}
+}
+
+func (c *consumptionBaseline) saveState(s *state) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s.Baselines = make(map[string]*siteBaseline)
+	for site, baseline := range c.sites {
+		copied := *baseline
+		copied.LastPower = copyValues(baseline.LastPower)
+		copied.Slots = append([]baselineSlot(nil), baseline.Slots...)
+		s.Baselines[site] = &copied
+	}
+}
+
+func (c *consumptionBaseline) restoreState(s *state) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg := c.config.get()
+	for site, baseline := range s.Baselines {
+		if !cfg.hasSite(site) {
+			continue
+		}
+		if len(baseline.Slots) != hoursPerWeek {
+			baseline.Slots = make([]baselineSlot, hoursPerWeek)
+		}
+		c.sites[site] = baseline
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHourOfWeek(t *testing.T) {
+	vienna := SiteConfig{Timezone: "Europe/Vienna"}.timeLocation()
+
+	for _, c := range []struct {
+		at       time.Time
+		wantHour string
+		wantSlot int
+	}{
+		{time.Date(2024, 3, 3, 0, 30, 0, 0, vienna), "2024-03-03T00", 0},
+		{time.Date(2024, 3, 4, 7, 30, 0, 0, vienna), "2024-03-04T07", 31},
+		{time.Date(2024, 3, 9, 23, 30, 0, 0, vienna), "2024-03-09T23", 167},
+		// 06:30 UTC is 07:30 in Vienna in winter.
+		{time.Date(2024, 3, 4, 6, 30, 0, 0, time.UTC).In(vienna), "2024-03-04T07", 31},
+	} {
+		hour, slot := hourOfWeek(c.at)
+		if hour != c.wantHour || slot != c.wantSlot {
+			t.Errorf("hourOfWeek(%v) = %s, %d, want %s, %d", c.at, hour, slot, c.wantHour, c.wantSlot)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// benchTransport answers the requests to the API with synthetic energy flows
+// instead of sending them. Other endpoints aren't available.
+type benchTransport struct {
+	latency time.Duration
+}
+
+func (t *benchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	time.Sleep(t.latency)
+
+	res := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+
+	// Only the energy flow of a site is served, not the one of its devices.
+	if strings.Count(req.URL.Path, "/") != 5 || !strings.HasSuffix(req.URL.Path, "/energy-flow/latest") {
+		return res, nil
+	}
+
+	bs, err := json.Marshal(syntheticEnergyFlow(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	res.StatusCode = http.StatusOK
+	res.Header.Set("Content-Type", "application/json")
+	res.Body = ioutil.NopCloser(bytes.NewReader(bs))
+	return res, nil
+}
+
+// syntheticEnergyFlow returns a random but balanced energy flow of a site
+// with PV modules and storages.
+func syntheticEnergyFlow(t time.Time) *EnergyFlow {
+	value := func(v float64) MetricValue {
+		return MetricValue{Value: &v, Time: t}
+	}
+
+	consumption := 300 + rand.Float64()*1000
+	heating := rand.Float64() * consumption / 2
+	production := rand.Float64() * 5000
+	storage := (rand.Float64() - 0.5) * 3000
+	grid := consumption - production - storage
+
+	return &EnergyFlow{
+		PowerConsumption:          value(consumption),
+		PowerConsumptionCalc:      value(consumption),
+		PowerProduction:           value(production),
+		PowerStorage:              value(storage),
+		PowerGrid:                 value(grid),
+		PowerHeating:              value(heating),
+		PowerAppliances:           value(consumption - heating),
+		StateOfCharge:             value(rand.Float64() * 100),
+		SelfSufficiency:           value(rand.Float64()),
+		ConsumersTotalCount:       2,
+		ConsumersOnlineCount:      2,
+		ProducersTotalCount:       1,
+		ProducersOnlineCount:      1,
+		StoragesTotalCount:        1,
+		StoragesOnlineCount:       1,
+		HeatingTotalCount:         1,
+		HeatingsOnlineCount:       1,
+		ChargingPointsTotalCount:  1,
+		ChargingPointsOnlineCount: 1,
+	}
+}
+
+// benchResult is the outcome of a benchmark.
+type benchResult struct {
+	Sites  int `json:"sites"`
+	Cycles int `json:"cycles"`
+	// The durations of the poll cycles in seconds.
+	CycleMin float64 `json:"cycle_seconds_min"`
+	CycleAvg float64 `json:"cycle_seconds_avg"`
+	CycleMax float64 `json:"cycle_seconds_max"`
+	// SitesPerSecond is the number of sites polled per second, and
+	// MaxSites the number of sites which can be polled at this rate within
+	// the poll interval.
+	SitesPerSecond float64 `json:"sites_per_second"`
+	MaxSites       int     `json:"max_sites"`
+	// HeapBytes is the memory allocated for the sites after a garbage
+	// collection, SysBytes the memory obtained from the OS in total.
+	HeapBytes        uint64 `json:"heap_bytes"`
+	HeapBytesPerSite uint64 `json:"heap_bytes_per_site"`
+	SysBytes         uint64 `json:"sys_bytes"`
+	MetricFamilies   int    `json:"metric_families"`
+	Series           int    `json:"series"`
+	SeriesPerSite    int    `json:"series_per_site"`
+}
+
+// heapAlloc returns the bytes allocated on the heap after a garbage
+// collection.
+func heapAlloc() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// benchHeartbeats receives the heartbeats of the poller under benchmark,
+// which it sends after every successful poll cycle.
+type benchHeartbeats struct {
+	beats chan time.Time
+}
+
+func (h *benchHeartbeats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case h.beats <- time.Now():
+	default:
+	}
+}
+
+// bench polls synthetic sites through the components of the collector to
+// tell how many sites a collector can handle.
+func bench(sites, cycles int, latency time.Duration) (*benchResult, error) {
+	cfg := &Config{APIKey: "bench"}
+	for i := 0; i < sites; i++ {
+		cfg.Sites = append(cfg.Sites, SiteConfig{
+			ID:              fmt.Sprintf("bench-%04d", i),
+			StorageCapacity: 10000,
+			PeakPower:       10,
+		})
+	}
+
+	bounds, err := parseSoCBands(*socBands)
+	if err != nil {
+		return nil, err
+	}
+
+	// The poller signals the end of its poll cycles through the heartbeat,
+	// like to a dead man's switch.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	// The cycle running at the end completes without being measured.
+	heartbeats := &benchHeartbeats{beats: make(chan time.Time, cycles+1)}
+	srv := &http.Server{Handler: heartbeats}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	before := heapAlloc()
+
+	config := newConfigStore(cfg)
+	reg := prometheus.NewRegistry()
+	pipe := newPipeline(reg, config, bounds)
+	p := &poller{
+		config:       config,
+		paused:       pipe.paused,
+		heartbeatURL: fmt.Sprintf("http://%s/", l.Addr()),
+		observers:    pipe.observers,
+		client:       &http.Client{Transport: &benchTransport{latency: latency}},
+		// Poll the sites again right away.
+		interval: time.Nanosecond,
+	}
+
+	// The poller sends no heartbeat after a failed poll cycle. As the sites
+	// are polled one after the other, a cycle takes as long as the latency of
+	// all of them and some time for the processing.
+	timeout := time.Minute + 2*time.Duration(sites)*latency
+
+	result := &benchResult{Sites: sites, Cycles: cycles}
+	var total time.Duration
+	start := time.Now()
+	p.start()
+	for i := 0; i < cycles; i++ {
+		var end time.Time
+		select {
+		case end = <-heartbeats.beats:
+		case <-time.After(timeout):
+			p.stop()
+			return nil, fmt.Errorf("no heartbeat after poll cycle %d", i+1)
+		}
+		d := end.Sub(start)
+		start = end
+
+		total += d
+		if i == 0 || d.Seconds() < result.CycleMin {
+			result.CycleMin = d.Seconds()
+		}
+		if d.Seconds() > result.CycleMax {
+			result.CycleMax = d.Seconds()
+		}
+	}
+	p.stop()
+	result.CycleAvg = total.Seconds() / float64(cycles)
+	result.SitesPerSecond = float64(sites*cycles) / total.Seconds()
+	result.MaxSites = int(result.SitesPerSecond * pollInterval.Seconds())
+
+	families, err := reg.Gather()
+	if err != nil {
+		return nil, err
+	}
+	result.MetricFamilies = len(families)
+	for _, family := range families {
+		result.Series += len(family.Metric)
+	}
+	result.SeriesPerSite = result.Series / sites
+
+	after := heapAlloc()
+	if after > before {
+		result.HeapBytes = after - before
+	}
+	result.HeapBytesPerSite = result.HeapBytes / uint64(sites)
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	result.SysBytes = stats.Sys
+
+	// Keep the components alive until the memory is measured.
+	runtime.KeepAlive(pipe)
+
+	return result, nil
+}
+
+func printBenchResult(w io.Writer, r *benchResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Sites:\t%d\n", r.Sites)
+	fmt.Fprintf(tw, "Poll cycles:\t%d\n", r.Cycles)
+	fmt.Fprintf(tw, "Poll cycle (min/avg/max):\t%.3fs / %.3fs / %.3fs\n", r.CycleMin, r.CycleAvg, r.CycleMax)
+	fmt.Fprintf(tw, "Throughput:\t%.1f sites/s\n", r.SitesPerSecond)
+	fmt.Fprintf(tw, "Max sites per poll interval:\t%d\n", r.MaxSites)
+	fmt.Fprintf(tw, "Heap:\t%.1f MiB (%.1f KiB per site)\n", float64(r.HeapBytes)/(1<<20), float64(r.HeapBytesPerSite)/(1<<10))
+	fmt.Fprintf(tw, "Memory from OS:\t%.1f MiB\n", float64(r.SysBytes)/(1<<20))
+	fmt.Fprintf(tw, "Metric families:\t%d\n", r.MetricFamilies)
+	fmt.Fprintf(tw, "Series:\t%d (%d per site)\n", r.Series, r.SeriesPerSite)
+	tw.Flush()
+}
+
+// runBench simulates synthetic sites and reports the poll throughput, memory
+// usage and series counts.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	sites := fs.Int("sites", 100, "Number of synthetic sites to simulate")
+	cycles := fs.Int("cycles", 5, "Number of poll cycles to run")
+	latency := fs.Duration("latency", 0, "Simulated latency of each API request, e.g. 200ms")
+	format := fs.String("format", "table", "Output format (table or json)")
+	fs.Parse(args)
+
+	if *sites < 1 || *cycles < 1 {
+		fmt.Fprintf(os.Stderr, "At least one site and one poll cycle required\n")
+		return 1
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown format %q\n", *format)
+		return 1
+	}
+
+	result, err := bench(*sites, *cycles, *latency)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run benchmark: %v\n", err)
+		return 1
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+		return 0
+	}
+
+	printBenchResult(os.Stdout, result)
+	return 0
+}
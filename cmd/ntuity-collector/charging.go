@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ChargingState is the state of a charging point and the vehicle connected
+// to it. Values which the charging point or vehicle doesn't report are null.
+type ChargingState struct {
+	// VehicleStateOfCharge is the state of charge of the vehicle in percent.
+	VehicleStateOfCharge MetricValue `json:"vehicle_state_of_charge"`
+	// Connected is 1 while a vehicle is plugged in and 0 otherwise.
+	Connected MetricValue `json:"connected"`
+	// CurrentRequested and CurrentDelivered are the charging currents in A
+	// the vehicle requests and the charging point delivers.
+	CurrentRequested MetricValue `json:"current_requested"`
+	CurrentDelivered MetricValue `json:"current_delivered"`
+}
+
+func retrieveChargingState(url, apiKey string) (*ChargingState, error) {
+	var state ChargingState
+	if err := retrieve("charging_state", url, apiKey, &state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// siteChargingPoints holds the charging points of a site.
+type siteChargingPoints struct {
+	devices []Device
+	// unavailable holds the charging points without charging state. They
+	// aren't asked again until the next refresh of the list.
+	unavailable map[string]bool
+	listed      time.Time
+}
+
+// chargingStateCollector retrieves the state of the vehicles connected to the
+// charging points of each site.
+type chargingStateCollector struct {
+	mu     sync.Mutex
+	lists  *deviceLists
+	sites  map[string]*siteChargingPoints
+	config *configStore
+
+	vehicleSoC       *prometheus.GaugeVec
+	connected        *prometheus.GaugeVec
+	currentRequested *prometheus.GaugeVec
+	currentDelivered *prometheus.GaugeVec
+}
+
+func newChargingStateCollector(reg *prometheus.Registry, config *configStore, lists *deviceLists) *chargingStateCollector {
+	labels := []string{"site", "device", "name"}
+	c := &chargingStateCollector{
+		lists:  lists,
+		sites:  make(map[string]*siteChargingPoints),
+		config: config,
+		vehicleSoC: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "charging_point_vehicle_state_of_charge",
+				Help:      "State of charge of the vehicle connected to the charging point",
+			},
+			labels,
+		),
+		connected: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "charging_point_vehicle_connected",
+				Help:      "Whether a vehicle is plugged into the charging point (1) or not (0)",
+			},
+			labels,
+		),
+		currentRequested: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "charging_point_current_requested_amperes",
+				Help:      "Charging current requested by the vehicle connected to the charging point",
+			},
+			labels,
+		),
+		currentDelivered: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "charging_point_current_delivered_amperes",
+				Help:      "Charging current delivered by the charging point",
+			},
+			labels,
+		),
+	}
+
+	reg.MustRegister(c.vehicleSoC, c.connected, c.currentRequested, c.currentDelivered)
+
+	config.onRemoveSite(func(site string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.sites, site)
+		c.deleteSite(site)
+	})
+
+	return c
+}
+
+func (c *chargingStateCollector) deleteSite(site string) {
+	for _, g := range []*prometheus.GaugeVec{c.vehicleSoC, c.connected, c.currentRequested, c.currentDelivered} {
+		g.DeletePartialMatch(prometheus.Labels{"site": site})
+	}
+}
+
+// deleteDevices drops the charging points which don't exist anymore or were
+// renamed.
+func (c *chargingStateCollector) deleteDevices(site string, old, current []Device) {
+	for _, device := range removedDevices(old, current) {
+		for _, g := range []*prometheus.GaugeVec{c.vehicleSoC, c.connected, c.currentRequested, c.currentDelivered} {
+			g.DeleteLabelValues(site, device.ID, device.Name)
+		}
+	}
+}
+
+// setOrDelete sets the gauge to the value or deletes it if the value isn't
+// reported.
+func setOrDelete(g *prometheus.GaugeVec, v MetricValue, labels ...string) {
+	if v.Value == nil {
+		g.DeleteLabelValues(labels...)
+		return
+	}
+	g.WithLabelValues(labels...).Set(*v.Value)
+}
+
+func (c *chargingStateCollector) observe(site string, flow *EnergyFlow) {
+	cfg := c.config.get()
+	siteConfig, ok := cfg.site(site)
+	if !ok {
+		return
+	}
+	apiKey := cfg.apiKey(siteConfig)
+
+	list := c.lists.get(site, apiKey, chargingPoints)
+
+	c.mu.Lock()
+	s, ok := c.sites[site]
+	if !ok {
+		s = &siteChargingPoints{}
+		c.sites[site] = s
+	}
+	if list.listed.After(s.listed) {
+		c.deleteDevices(site, s.devices, list.devices)
+		s.devices = list.devices
+		s.unavailable = make(map[string]bool)
+		s.listed = list.listed
+	}
+	devices := s.devices
+	c.mu.Unlock()
+
+	for _, device := range devices {
+		c.mu.Lock()
+		unavailable := s.unavailable[device.ID]
+		c.mu.Unlock()
+		if unavailable {
+			continue
+		}
+
+		state, err := retrieveChargingState(fmt.Sprintf(chargingURL, site, device.ID), apiKey)
+		if err != nil {
+			if isNotAvailable(err) {
+				c.mu.Lock()
+				s.unavailable[device.ID] = true
+				c.mu.Unlock()
+				continue
+			}
+			logError("Failed to collect charging state of charging point %s of site %s: %v", device.ID, site, err)
+			continue
+		}
+
+		setOrDelete(c.vehicleSoC, state.VehicleStateOfCharge, site, device.ID, device.Name)
+		setOrDelete(c.connected, state.Connected, site, device.ID, device.Name)
+		setOrDelete(c.currentRequested, state.CurrentRequested, site, device.ID, device.Name)
+		setOrDelete(c.currentDelivered, state.CurrentDelivered, site, device.ID, device.Name)
+	}
+}
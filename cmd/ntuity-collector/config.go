@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	// The time zones of the sites are resolved without relying on the
+	// time zone database of the host, which containers often lack.
+	_ "time/tzdata"
+)
+
+// Config describes the sites to collect metrics for. References to
+// environment variables like ${NTUITY_API_KEY} in string values of the
+// configuration file are substituted when it's loaded.
+type Config struct {
+	APIKey  string         `json:"api_key,omitempty"`
+	Sites   []SiteConfig   `json:"sites"`
+	Tenants []TenantConfig `json:"tenants,omitempty"`
+	Outputs []OutputConfig `json:"outputs,omitempty"`
+}
+
+type SiteConfig struct {
+	ID string `json:"id"`
+	// APIKey overrides the global API key for this site.
+	APIKey string        `json:"api_key,omitempty"`
+	Tariff *TariffConfig `json:"tariff,omitempty"`
+	Prices *PriceConfig  `json:"prices,omitempty"`
+	// Tenant is the name of the tenant the site belongs to.
+	Tenant string `json:"tenant,omitempty"`
+	// Timezone is the IANA time zone of the site, e.g. Europe/Vienna, which
+	// tariff periods and the start of days and months refer to. The time zone
+	// of the collector is used by default.
+	Timezone string `json:"timezone,omitempty"`
+	// StorageCapacity is the usable capacity of all storages in Wh.
+	StorageCapacity float64 `json:"storage_capacity_wh,omitempty"`
+	// PeakPower is the installed peak power of the PV modules in kWp.
+	PeakPower float64         `json:"peak_power_kwp,omitempty"`
+	Location  *LocationConfig `json:"location,omitempty"`
+	// HeatingBaseTemperature is the outdoor temperature in °C below which
+	// the site is heated, 15 °C by default.
+	HeatingBaseTemperature *float64 `json:"heating_base_temperature,omitempty"`
+
+	FeedInLimit *FeedInLimitConfig `json:"feed_in_limit,omitempty"`
+
+	// Labels are exported with ntuity_site_labels to group sites.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// timeLocations caches the loaded time zones by name.
+var timeLocations sync.Map
+
+// loadTimeLocation loads the time zone of the given name, the time zone of
+// the collector for an empty one.
+func loadTimeLocation(name string) (*time.Location, error) {
+	if len(name) == 0 {
+		return time.Local, nil
+	}
+	if loc, ok := timeLocations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	timeLocations.Store(name, loc)
+	return loc, nil
+}
+
+// timeLocation returns the time zone of the site.
+func (s SiteConfig) timeLocation() *time.Location {
+	loc, err := loadTimeLocation(s.Timezone)
+	if err != nil {
+		// Invalid time zones are rejected by validate.
+		return time.Local
+	}
+	return loc
+}
+
+// loadConfig reads the configuration file if one is given and adds the sites
+// given on the command line.
+func loadConfig() (*Config, error) {
+	cfg := &Config{}
+
+	if len(*configFile) > 0 {
+		bs, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := parseConfig(bs, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", *configFile, err)
+		}
+	}
+
+	if len(*siteID) > 0 {
+		for _, id := range strings.Split(*siteID, ",") {
+			cfg.Sites = append(cfg.Sites, SiteConfig{ID: id})
+		}
+	}
+
+	if len(cfg.APIKey) == 0 {
+		cfg.APIKey = os.Getenv("NTUITY_API_KEY")
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	// The sites discovered from Kubernetes are only known once they're
+	// merged in by configStore.apply.
+	if len(*kubernetesSites) == 0 {
+		if err := cfg.validateOutputSites(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// envReference matches a reference to an environment variable.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// parseConfig parses the configuration file after substituting the
+// references to environment variables in its string values. Only ${NAME} is
+// substituted, so that values containing a bare $ like passwords are kept,
+// and the substituted values can't change the structure of the file.
+func parseConfig(bs []byte, cfg *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("unexpected data after the configuration")
+	}
+
+	expanded, err := json.Marshal(expandEnv(doc))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(expanded, cfg)
+}
+
+// expandEnv substitutes the references to environment variables in the
+// string values of the decoded JSON value.
+func expandEnv(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return envReference.ReplaceAllStringFunc(v, func(ref string) string {
+			return os.Getenv(envReference.FindStringSubmatch(ref)[1])
+		})
+	case []interface{}:
+		for i := range v {
+			v[i] = expandEnv(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = expandEnv(v[k])
+		}
+	}
+	return v
+}
+
+func (c *Config) validate() error {
+	if len(c.Sites) == 0 && len(*kubernetesSites) == 0 {
+		return fmt.Errorf("no site ID given")
+	}
+
+	seen := make(map[string]bool)
+	for _, site := range c.Sites {
+		if len(site.ID) == 0 {
+			return fmt.Errorf("site without ID given")
+		}
+		if seen[site.ID] {
+			return fmt.Errorf("site %s given more than once", site.ID)
+		}
+		seen[site.ID] = true
+
+		if len(c.apiKey(site)) == 0 {
+			return fmt.Errorf("no api key given for site %s", site.ID)
+		}
+
+		if _, err := loadTimeLocation(site.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone for site %s: %v", site.ID, err)
+		}
+
+		if site.StorageCapacity < 0 {
+			return fmt.Errorf("negative storage capacity given for site %s", site.ID)
+		}
+
+		if site.PeakPower < 0 {
+			return fmt.Errorf("negative peak power given for site %s", site.ID)
+		}
+
+		if site.Location != nil {
+			if err := site.Location.validate(); err != nil {
+				return fmt.Errorf("invalid location for site %s: %v", site.ID, err)
+			}
+		}
+
+		if site.FeedInLimit != nil {
+			if err := site.FeedInLimit.validate(site); err != nil {
+				return fmt.Errorf("invalid feed-in limit for site %s: %v", site.ID, err)
+			}
+		}
+
+		if site.Tariff != nil {
+			if err := site.Tariff.validate(); err != nil {
+				return fmt.Errorf("invalid tariff for site %s: %v", site.ID, err)
+			}
+		}
+
+		if err := validateSiteLabels(site.Labels); err != nil {
+			return fmt.Errorf("invalid labels for site %s: %v", site.ID, err)
+		}
+	}
+
+	if err := c.validateTenants(); err != nil {
+		return err
+	}
+
+	return c.validateOutputs()
+}
+
+// redactedSecret replaces secrets in the effective configuration.
+const redactedSecret = "<secret>"
+
+func redact(secret string) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	return redactedSecret
+}
+
+// redacted returns a copy of the configuration with all secrets replaced.
+func (c *Config) redacted() *Config {
+	r := *c
+	r.APIKey = redact(c.APIKey)
+
+	r.Sites = make([]SiteConfig, len(c.Sites))
+	for i, site := range c.Sites {
+		site.APIKey = redact(site.APIKey)
+		r.Sites[i] = site
+	}
+
+	r.Outputs = make([]OutputConfig, len(c.Outputs))
+	for i, output := range c.Outputs {
+		if output.Shelly != nil {
+			shelly := *output.Shelly
+			shelly.Password = redact(shelly.Password)
+			output.Shelly = &shelly
+		}
+		if output.Tasmota != nil {
+			tasmota := *output.Tasmota
+			tasmota.Password = redact(tasmota.Password)
+			output.Tasmota = &tasmota
+		}
+		r.Outputs[i] = output
+	}
+
+	r.Tenants = make([]TenantConfig, len(c.Tenants))
+	for i, tenant := range c.Tenants {
+		tenant.Password = redact(tenant.Password)
+		r.Tenants[i] = tenant
+	}
+
+	return &r
+}
+
+func (c *Config) apiKey(site SiteConfig) string {
+	if len(site.APIKey) > 0 {
+		return site.APIKey
+	}
+	return c.APIKey
+}
+
+func (c *Config) hasSite(id string) bool {
+	_, ok := c.site(id)
+	return ok
+}
+
+func (c *Config) site(id string) (SiteConfig, bool) {
+	for _, site := range c.Sites {
+		if site.ID == id {
+			return site, true
+		}
+	}
+	return SiteConfig{}, false
+}
+
+// siteLocation returns the time zone of the site, the one of the collector
+// for unknown sites.
+func (c *Config) siteLocation(id string) *time.Location {
+	site, ok := c.site(id)
+	if !ok {
+		return time.Local
+	}
+	return site.timeLocation()
+}
+
+// configStore holds the currently active configuration and notifies
+// interested parties about sites being added or removed on reload. The
+// active configuration is the one of the configuration file extended by the
+// sites discovered dynamically, e.g. from Kubernetes.
+type configStore struct {
+	mu       sync.RWMutex
+	cfg      *Config
+	onAdd    []func(site string)
+	onRemove []func(site string)
+
+	// update serializes updates of the configuration file and the dynamic
+	// sites.
+	update  sync.Mutex
+	file    *Config
+	dynamic []SiteConfig
+}
+
+func newConfigStore(cfg *Config) *configStore {
+	return &configStore{cfg: cfg, file: cfg}
+}
+
+func (s *configStore) get() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+func (s *configStore) onAddSite(fn func(site string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onAdd = append(s.onAdd, fn)
+}
+
+func (s *configStore) onRemoveSite(fn func(site string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onRemove = append(s.onRemove, fn)
+}
+
+// reload re-reads the configuration file and replaces the active
+// configuration if it's valid.
+func (s *configStore) reload() error {
+	file, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	s.update.Lock()
+	defer s.update.Unlock()
+
+	if err := s.apply(file, s.dynamic); err != nil {
+		return err
+	}
+	s.file = file
+	return nil
+}
+
+// setDynamicSites replaces the dynamically discovered sites if the resulting
+// configuration is valid.
+func (s *configStore) setDynamicSites(sites []SiteConfig) error {
+	s.update.Lock()
+	defer s.update.Unlock()
+
+	if err := s.apply(s.file, sites); err != nil {
+		return err
+	}
+	s.dynamic = sites
+	return nil
+}
+
+// apply activates the configuration file extended by the dynamic sites and
+// notifies about added and removed sites.
+func (s *configStore) apply(file *Config, dynamic []SiteConfig) error {
+	cfg := file
+	if len(dynamic) > 0 {
+		merged := *file
+		merged.Sites = append(append([]SiteConfig(nil), file.Sites...), dynamic...)
+		if err := merged.validate(); err != nil {
+			return err
+		}
+		cfg = &merged
+	}
+	if err := cfg.validateOutputSites(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	old := s.cfg
+	s.cfg = cfg
+	onAdd, onRemove := s.onAdd, s.onRemove
+	s.mu.Unlock()
+
+	for _, site := range old.Sites {
+		if !cfg.hasSite(site.ID) {
+			for _, fn := range onRemove {
+				fn(site.ID)
+			}
+		}
+	}
+
+	for _, site := range cfg.Sites {
+		if !old.hasSite(site.ID) {
+			for _, fn := range onAdd {
+				fn(site.ID)
+			}
+		}
+	}
+
+	return nil
+}
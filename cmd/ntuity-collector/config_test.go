@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseConfigExpandsEnv(t *testing.T) {
+	os.Setenv("TEST_NTUITY_KEY", "key")
+	os.Setenv("TEST_NTUITY_PASSWORD", `se"cr\et`)
+	defer os.Unsetenv("TEST_NTUITY_KEY")
+	defer os.Unsetenv("TEST_NTUITY_PASSWORD")
+
+	var cfg Config
+	err := parseConfig([]byte(`{
+		"api_key": "${TEST_NTUITY_KEY}",
+		"sites": [{"id": "a", "storage_capacity_wh": 10000}],
+		"tenants": [
+			{"name": "x", "username": "x", "password": "p$ssw0rd"},
+			{"name": "y", "username": "y", "password": "${TEST_NTUITY_PASSWORD}"}
+		]
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.APIKey != "key" {
+		t.Errorf("api key = %q, want the one of the environment", cfg.APIKey)
+	}
+	if cfg.Sites[0].StorageCapacity != 10000 {
+		t.Errorf("storage capacity = %v, want 10000", cfg.Sites[0].StorageCapacity)
+	}
+	if got := cfg.Tenants[0].Password; got != "p$ssw0rd" {
+		t.Errorf("password with bare $ = %q, want it unchanged", got)
+	}
+	if got := cfg.Tenants[1].Password; got != `se"cr\et` {
+		t.Errorf("password from the environment = %q, want it verbatim", got)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceListRefreshInterval is the interval in which the devices of a site
+// are listed again to pick up added or removed devices.
+const deviceListRefreshInterval = time.Hour
+
+// deviceCategory maps the category label of the sub-consumption metrics to
+// the path of the corresponding API endpoints.
+type deviceCategory struct {
+	category string
+	path     string
+}
+
+var chargingPoints = deviceCategory{"charging_points", "charging-points"}
+
+var deviceCategories = []deviceCategory{
+	{"consumers", "consumers"},
+	{"heatings", "heatings"},
+	chargingPoints,
+}
+
+type Device struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type DeviceEnergyFlow struct {
+	Power MetricValue `json:"power"`
+}
+
+func retrieveDevices(url, apiKey string) ([]Device, error) {
+	var devices []Device
+	if err := retrieve("devices", url, apiKey, &devices); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+func retrieveDeviceEnergyFlow(url, apiKey string) (*DeviceEnergyFlow, error) {
+	var flow DeviceEnergyFlow
+	if err := retrieve("device_energy_flow", url, apiKey, &flow); err != nil {
+		return nil, err
+	}
+
+	return &flow, nil
+}
+
+// removedDevices returns the devices of old which aren't in current, including
+// the ones which were renamed.
+func removedDevices(old, current []Device) []Device {
+	listed := make(map[Device]bool)
+	for _, device := range current {
+		listed[device] = true
+	}
+
+	var removed []Device
+	for _, device := range old {
+		if !listed[device] {
+			removed = append(removed, device)
+		}
+	}
+	return removed
+}
+
+// deviceList holds the devices of a category of a site.
+type deviceList struct {
+	devices []Device
+	// listed is the time the devices were last listed successfully.
+	listed time.Time
+}
+
+// deviceLists lists the devices of each site every deviceListRefreshInterval
+// for all collectors needing them, so that the lists are only retrieved once.
+type deviceLists struct {
+	mu    sync.Mutex
+	sites map[string]map[string]deviceList
+}
+
+func newDeviceLists(config *configStore) *deviceLists {
+	l := &deviceLists{sites: make(map[string]map[string]deviceList)}
+
+	config.onRemoveSite(func(site string) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.sites, site)
+	})
+
+	return l
+}
+
+// get returns the devices of the category of the site. Categories for which
+// the endpoint isn't available have no devices. If listing the devices fails,
+// the previous ones are returned and they are listed again with the next
+// call.
+func (l *deviceLists) get(site, apiKey string, category deviceCategory) deviceList {
+	l.mu.Lock()
+	list := l.sites[site][category.category]
+	l.mu.Unlock()
+
+	if time.Since(list.listed) < deviceListRefreshInterval {
+		return list
+	}
+
+	devices, err := retrieveDevices(fmt.Sprintf(devicesURL, site, category.path), apiKey)
+	if err != nil && !isNotAvailable(err) {
+		logError("Failed to list %s of site %s: %v", category.category, site, err)
+		return list
+	}
+	list = deviceList{devices: devices, listed: time.Now()}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sites[site] == nil {
+		l.sites[site] = make(map[string]deviceList)
+	}
+	l.sites[site][category.category] = list
+	return list
+}
+
+// devicePowerCollector retrieves the power of the single consumer devices of
+// each site, breaking down the aggregated consumption of the energy flow.
+type devicePowerCollector struct {
+	mu    sync.Mutex
+	lists *deviceLists
+	// sites holds the devices of each site per category whose power is
+	// exported.
+	sites  map[string]map[string][]Device
+	config *configStore
+	power  *prometheus.GaugeVec
+}
+
+func newDevicePowerCollector(reg *prometheus.Registry, config *configStore, lists *deviceLists) *devicePowerCollector {
+	c := &devicePowerCollector{
+		lists:  lists,
+		sites:  make(map[string]map[string][]Device),
+		config: config,
+		power: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "device_power",
+				Help:      "Power of a single consumer device",
+			},
+			[]string{"site", "category", "device", "name"},
+		),
+	}
+
+	reg.MustRegister(c.power)
+
+	config.onRemoveSite(func(site string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.sites, site)
+		c.power.DeletePartialMatch(prometheus.Labels{"site": site})
+	})
+
+	return c
+}
+
+func (c *devicePowerCollector) observe(site string, flow *EnergyFlow) {
+	cfg := c.config.get()
+	siteConfig, ok := cfg.site(site)
+	if !ok {
+		return
+	}
+	apiKey := cfg.apiKey(siteConfig)
+
+	for _, category := range deviceCategories {
+		devices := c.lists.get(site, apiKey, category).devices
+
+		c.mu.Lock()
+		// Drop devices which don't exist anymore.
+		for _, device := range removedDevices(c.sites[site][category.category], devices) {
+			c.power.DeleteLabelValues(site, category.category, device.ID, device.Name)
+		}
+		if c.sites[site] == nil {
+			c.sites[site] = make(map[string][]Device)
+		}
+		c.sites[site][category.category] = devices
+		c.mu.Unlock()
+
+		for _, device := range devices {
+			url := fmt.Sprintf(deviceFlowURL, site, category.path, device.ID)
+			flow, err := retrieveDeviceEnergyFlow(url, apiKey)
+			if err != nil {
+				logError("Failed to collect power of device %s of site %s: %v", device.ID, site, err)
+				continue
+			}
+
+			c.power.WithLabelValues(site, category.category, device.ID, device.Name).Set(flow.Power.float())
+		}
+	}
+}
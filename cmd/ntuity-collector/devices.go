@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type deviceCount struct {
+	category string
+	online   int
+	total    int
+}
+
+func deviceCounts(flow *EnergyFlow) []deviceCount {
+	return []deviceCount{
+		{"consumers", flow.ConsumersOnlineCount, flow.ConsumersTotalCount},
+		{"producers", flow.ProducersOnlineCount, flow.ProducersTotalCount},
+		{"storages", flow.StoragesOnlineCount, flow.StoragesTotalCount},
+		{"heatings", flow.HeatingsOnlineCount, flow.HeatingTotalCount},
+		{"charging_points", flow.ChargingPointsOnlineCount, flow.ChargingPointsTotalCount},
+		{"grids", flow.GridsOnlineCount, flow.GirdsTotalCount},
+	}
+}
+
+// deviceMetrics exports the number of online devices per category and counts
+// the transitions between online and offline, so flapping devices show up
+// even if they happen to be online at scrape time.
+type deviceMetrics struct {
+	mu         sync.Mutex
+	lastOnline map[string]map[string]int
+
+	online         *prometheus.GaugeVec
+	total          *prometheus.GaugeVec
+	offlineChanges *prometheus.CounterVec
+	onlineChanges  *prometheus.CounterVec
+}
+
+func newDeviceMetrics(reg *prometheus.Registry, config *configStore) *deviceMetrics {
+	m := &deviceMetrics{
+		lastOnline: make(map[string]map[string]int),
+		online: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "devices_online",
+				Help:      "Number of online devices per category",
+			},
+			[]string{"site", "category"},
+		),
+		total: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "devices_total",
+				Help:      "Number of devices per category",
+			},
+			[]string{"site", "category"},
+		),
+		offlineChanges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ntuity",
+				Name:      "device_offline_transitions_total",
+				Help:      "Number of devices per category which went offline",
+			},
+			[]string{"site", "category"},
+		),
+		onlineChanges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ntuity",
+				Name:      "device_online_transitions_total",
+				Help:      "Number of devices per category which came back online",
+			},
+			[]string{"site", "category"},
+		),
+	}
+
+	reg.MustRegister(m.online, m.total, m.offlineChanges, m.onlineChanges)
+
+	config.onRemoveSite(func(site string) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.lastOnline, site)
+		labels := prometheus.Labels{"site": site}
+		m.online.DeletePartialMatch(labels)
+		m.total.DeletePartialMatch(labels)
+		m.offlineChanges.DeletePartialMatch(labels)
+		m.onlineChanges.DeletePartialMatch(labels)
+	})
+
+	return m
+}
+
+func (m *deviceMetrics) observe(site string, flow *EnergyFlow) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	last, seen := m.lastOnline[site]
+	if !seen {
+		last = make(map[string]int)
+		m.lastOnline[site] = last
+	}
+
+	for _, c := range deviceCounts(flow) {
+		m.online.WithLabelValues(site, c.category).Set(float64(c.online))
+		m.total.WithLabelValues(site, c.category).Set(float64(c.total))
+
+		offline := m.offlineChanges.WithLabelValues(site, c.category)
+		online := m.onlineChanges.WithLabelValues(site, c.category)
+		if seen {
+			if diff := last[c.category] - c.online; diff > 0 {
+				offline.Add(float64(diff))
+			} else if diff < 0 {
+				online.Add(float64(-diff))
+			}
+		}
+
+		last[c.category] = c.online
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxIntegrationGap is the longest time between two samples of a site which
+// is still integrated. Longer gaps, e.g. while a site or the collector was
+// offline, are skipped instead of guessing what happened in between.
+const maxIntegrationGap = 15 * time.Minute
+
+// minRoundTripEnergy is the energy in Wh which has to be charged into the
+// storages of a site before their round-trip efficiency is estimated.
+const minRoundTripEnergy = 1000
+
+// powerIntegrator integrates the power values of consecutive samples into
+// energy using the trapezoidal rule.
+type powerIntegrator struct {
+	LastTime  time.Time          `json:"last_time"`
+	LastPower map[string]float64 `json:"last_power"`
+}
+
+// step takes the power values (in W) of a new sample and returns the energy
+// (in Wh) since the previous one. It returns false if the sample isn't newer
+// than the previous one, as the API keeps returning the last sample while a
+// site doesn't report new values. The returned energy is nil for the first
+// sample and after gaps longer than maxIntegrationGap.
+func (i *powerIntegrator) step(t time.Time, power map[string]float64) (map[string]float64, bool) {
+	if t.IsZero() || !t.After(i.LastTime) {
+		return nil, false
+	}
+
+	var energy map[string]float64
+	if dt := t.Sub(i.LastTime); dt <= maxIntegrationGap {
+		energy = make(map[string]float64, len(power))
+		for name, p := range power {
+			energy[name] = (i.LastPower[name] + p) / 2 * dt.Hours()
+		}
+	}
+
+	i.LastTime = t
+	i.LastPower = power
+
+	return energy, true
+}
+
+// siteEnergy holds the energy integrated from the power values of a site.
+type siteEnergy struct {
+	powerIntegrator
+	Total     map[string]float64 `json:"total"`
+	Day       string             `json:"day"`
+	Today     map[string]float64 `json:"today"`
+	Month     string             `json:"month"`
+	ThisMonth map[string]float64 `json:"this_month"`
+}
+
+// energyCounters integrates the power values reported for each site into
+// energy counters, in total as well as for the current day and month.
+type energyCounters struct {
+	mu     sync.Mutex
+	sites  map[string]*siteEnergy
+	config *configStore
+
+	totalDesc                *prometheus.Desc
+	todayDesc                *prometheus.Desc
+	monthDesc                *prometheus.Desc
+	selfSufficiencyTodayDesc *prometheus.Desc
+	selfSufficiencyMonthDesc *prometheus.Desc
+	roundTripEfficiencyDesc  *prometheus.Desc
+}
+
+func newEnergyCounters(reg *prometheus.Registry, config *configStore) *energyCounters {
+	e := &energyCounters{
+		sites:  make(map[string]*siteEnergy),
+		config: config,
+		totalDesc: prometheus.NewDesc(
+			"ntuity_energy_wh_total",
+			"Energy in Wh integrated from the power of the given flow",
+			[]string{"site", "flow"}, nil,
+		),
+		todayDesc: prometheus.NewDesc(
+			"ntuity_energy_today_wh",
+			"Energy in Wh integrated from the power of the given flow since local midnight",
+			[]string{"site", "flow"}, nil,
+		),
+		monthDesc: prometheus.NewDesc(
+			"ntuity_energy_month_wh",
+			"Energy in Wh integrated from the power of the given flow since the start of the month",
+			[]string{"site", "flow"}, nil,
+		),
+		selfSufficiencyTodayDesc: prometheus.NewDesc(
+			"ntuity_self_sufficiency_today_ratio",
+			"Share of today's consumption which wasn't imported from the grid",
+			[]string{"site"}, nil,
+		),
+		selfSufficiencyMonthDesc: prometheus.NewDesc(
+			"ntuity_self_sufficiency_month_ratio",
+			"Share of this month's consumption which wasn't imported from the grid",
+			[]string{"site"}, nil,
+		),
+		roundTripEfficiencyDesc: prometheus.NewDesc(
+			"ntuity_storage_round_trip_efficiency_ratio",
+			"Estimated round-trip efficiency of the storages, i.e. the energy discharged from per energy charged into them",
+			[]string{"site"}, nil,
+		),
+	}
+
+	reg.MustRegister(e)
+
+	config.onRemoveSite(func(site string) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.sites, site)
+	})
+
+	return e
+}
+
+// flowPowers splits the power values of an energy flow into non-negative
+// values per direction.
+func flowPowers(flow *EnergyFlow) map[string]float64 {
+	grid := flow.PowerGrid.float()
+	storage := flow.PowerStorage.float()
+
+	consumption := flow.PowerConsumption
+	if consumption.Value == nil {
+		consumption = flow.PowerConsumptionCalc
+	}
+
+	return map[string]float64{
+		"grid_import":       positive(grid),
+		"grid_export":       positive(-grid),
+		"production":        positive(flow.PowerProduction.float()),
+		"consumption":       positive(consumption.float()),
+		"storage_charge":    positive(-storage),
+		"storage_discharge": positive(storage),
+		"heating":           positive(flow.PowerHeating.float()),
+	}
+}
+
+func positive(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+func (e *energyCounters) observe(site string, flow *EnergyFlow) {
+	t := flow.timestamp().In(e.config.get().siteLocation(site))
+	power := flowPowers(flow)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, ok := e.sites[site]
+	if !ok {
+		s = &siteEnergy{
+			Total:     make(map[string]float64),
+			Today:     make(map[string]float64),
+			ThisMonth: make(map[string]float64),
+		}
+		e.sites[site] = s
+	}
+
+	energy, fresh := s.step(t, power)
+	if !fresh {
+		return
+	}
+
+	day := t.Format("2006-01-02")
+	if day != s.Day {
+		s.Day = day
+		s.Today = make(map[string]float64)
+	}
+
+	month := t.Format("2006-01")
+	if month != s.Month {
+		s.Month = month
+		s.ThisMonth = make(map[string]float64)
+	}
+
+	for name, wh := range energy {
+		s.Total[name] += wh
+		s.Today[name] += wh
+		s.ThisMonth[name] += wh
+	}
+}
+
+func (e *energyCounters) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.totalDesc
+	ch <- e.todayDesc
+	ch <- e.monthDesc
+	ch <- e.selfSufficiencyTodayDesc
+	ch <- e.selfSufficiencyMonthDesc
+	ch <- e.roundTripEfficiencyDesc
+}
+
+func (e *energyCounters) Collect(ch chan<- prometheus.Metric) {
+	cfg := e.config.get()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	for site, s := range e.sites {
+		local := now.In(cfg.siteLocation(site))
+		todayValues := s.Today
+		if s.Day != local.Format("2006-01-02") {
+			todayValues = nil
+		}
+		monthValues := s.ThisMonth
+		if s.Month != local.Format("2006-01") {
+			monthValues = nil
+		}
+
+		for name, wh := range s.Total {
+			ch <- prometheus.MustNewConstMetric(e.totalDesc, prometheus.CounterValue, wh, site, name)
+			ch <- prometheus.MustNewConstMetric(e.todayDesc, prometheus.GaugeValue, todayValues[name], site, name)
+			ch <- prometheus.MustNewConstMetric(e.monthDesc, prometheus.GaugeValue, monthValues[name], site, name)
+		}
+
+		if ratio, ok := selfSufficiency(todayValues); ok {
+			ch <- prometheus.MustNewConstMetric(e.selfSufficiencyTodayDesc, prometheus.GaugeValue, ratio, site)
+		}
+		if ratio, ok := selfSufficiency(monthValues); ok {
+			ch <- prometheus.MustNewConstMetric(e.selfSufficiencyMonthDesc, prometheus.GaugeValue, ratio, site)
+		}
+		if ratio, ok := roundTripEfficiency(s.Total); ok {
+			ch <- prometheus.MustNewConstMetric(e.roundTripEfficiencyDesc, prometheus.GaugeValue, ratio, site)
+		}
+	}
+}
+
+// today returns the energy in Wh of the given flow of the site since
+// midnight. It returns false if no energy was integrated for the site yet.
+func (e *energyCounters) today(site, flow string) (float64, bool) {
+	now := time.Now().In(e.config.get().siteLocation(site))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, ok := e.sites[site]
+	if !ok {
+		return 0, false
+	}
+	if s.Day != now.Format("2006-01-02") {
+		return 0, true
+	}
+	return s.Today[flow], true
+}
+
+// month returns the energy in Wh of the given flow of the site since the
+// start of the month. It returns false if no energy was integrated for the
+// site yet.
+func (e *energyCounters) month(site, flow string) (float64, bool) {
+	now := time.Now().In(e.config.get().siteLocation(site))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, ok := e.sites[site]
+	if !ok {
+		return 0, false
+	}
+	if s.Month != now.Format("2006-01") {
+		return 0, true
+	}
+	return s.ThisMonth[flow], true
+}
+
+// roundTripEfficiency estimates the round-trip efficiency of the storages
+// from the energy charged into and discharged from them. As the state of
+// charge isn't taken into account, the estimate gets more accurate the more
+// cycles the storages went through.
+func roundTripEfficiency(energy map[string]float64) (float64, bool) {
+	charged := energy["storage_charge"]
+	if charged < minRoundTripEnergy {
+		return 0, false
+	}
+	return energy["storage_discharge"] / charged, true
+}
+
+// selfSufficiency returns the energy weighted share of the consumption which
+// wasn't imported from the grid.
+func selfSufficiency(energy map[string]float64) (float64, bool) {
+	consumption := energy["consumption"]
+	if consumption <= 0 {
+		return 0, false
+	}
+
+	ratio := 1 - energy["grid_import"]/consumption
+	if ratio < 0 {
+		ratio = 0
+	}
+	return ratio, true
+}
+
+func (e *energyCounters) saveState(s *state) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s.Energy = make(map[string]*siteEnergy)
+	for site, energy := range e.sites {
+		copied := *energy
+		copied.LastPower = copyValues(energy.LastPower)
+		copied.Total = copyValues(energy.Total)
+		copied.Today = copyValues(energy.Today)
+		copied.ThisMonth = copyValues(energy.ThisMonth)
+		s.Energy[site] = &copied
+	}
+}
+
+func (e *energyCounters) restoreState(s *state) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	cfg := e.config.get()
+	for site, energy := range s.Energy {
+		if !cfg.hasSite(site) {
+			continue
+		}
+		if energy.Total == nil {
+			energy.Total = make(map[string]float64)
+		}
+		if energy.Today == nil {
+			energy.Today = make(map[string]float64)
+		}
+		if energy.ThisMonth == nil {
+			energy.ThisMonth = make(map[string]float64)
+		}
+		e.sites[site] = energy
+	}
+}
+
+func copyValues(m map[string]float64) map[string]float64 {
+	c := make(map[string]float64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEnergyDayInSiteTimezone(t *testing.T) {
+	cfg := &Config{
+		APIKey: "key",
+		Sites:  []SiteConfig{{ID: "a", Timezone: "Pacific/Auckland"}},
+	}
+	e := newEnergyCounters(prometheus.NewRegistry(), newConfigStore(cfg))
+
+	flow := func(at string) *EnergyFlow {
+		ts, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := 1000.0
+		return &EnergyFlow{PowerConsumption: MetricValue{Value: &v, Time: ts}}
+	}
+
+	// Midnight in Auckland is at 11:00 UTC while daylight saving time.
+	for _, c := range []struct {
+		at   string
+		want string
+	}{
+		{"2024-03-04T10:50:00Z", "2024-03-04"},
+		{"2024-03-04T10:59:00Z", "2024-03-04"},
+		{"2024-03-04T11:01:00Z", "2024-03-05"},
+	} {
+		e.observe("a", flow(c.at))
+		if got := e.sites["a"].Day; got != c.want {
+			t.Errorf("day at %s = %s, want %s", c.at, got, c.want)
+		}
+	}
+
+	if got := e.sites["a"].Today["consumption"]; got <= 0 || got > 1000.0/60*2 {
+		t.Errorf("consumption of the new day = %v Wh, want at most the two minutes since 10:59", got)
+	}
+}
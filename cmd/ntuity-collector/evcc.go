@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latestFlows keeps the latest energy flow of each site.
+type latestFlows struct {
+	mu    sync.Mutex
+	flows map[string]*EnergyFlow
+}
+
+func newLatestFlows(config *configStore) *latestFlows {
+	l := &latestFlows{flows: make(map[string]*EnergyFlow)}
+
+	config.onRemoveSite(func(site string) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.flows, site)
+	})
+
+	return l
+}
+
+func (l *latestFlows) observe(site string, flow *EnergyFlow) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flows[site] = flow
+}
+
+func (l *latestFlows) get(site string) (*EnergyFlow, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	flow, ok := l.flows[site]
+	return flow, ok
+}
+
+// evccValues are the values served for evcc's custom meter plugin. The signs
+// match the ones evcc expects: grid power is positive while importing and
+// battery power while discharging.
+var evccValues = map[string]func(flow *EnergyFlow) MetricValue{
+	"grid-power":    func(flow *EnergyFlow) MetricValue { return flow.PowerGrid },
+	"pv-power":      func(flow *EnergyFlow) MetricValue { return flow.PowerProduction },
+	"battery-power": func(flow *EnergyFlow) MetricValue { return flow.PowerStorage },
+	"battery-soc":   func(flow *EnergyFlow) MetricValue { return flow.StateOfCharge },
+}
+
+// registerEvccHandlers serves the values of the latest energy flow of each
+// site as bare JSON numbers below /evcc/{site}/.
+func registerEvccHandlers(config *configStore, flows *latestFlows) {
+	http.HandleFunc("/evcc/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/evcc/"), "/")
+		if len(parts) != 2 || !config.get().hasSite(parts[0]) {
+			http.NotFound(w, r)
+			return
+		}
+		value, ok := evccValues[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		// evcc has to notice when the values are outdated instead of
+		// controlling chargers based on them.
+		flow, ok := flows.get(parts[0])
+		if !ok || time.Since(flow.timestamp()) > outputStaleness {
+			http.Error(w, fmt.Sprintf("No recent energy flow for site %s", parts[0]), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value(flow).float())
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FeedInLimitConfig limits the power exported to the grid, either to a fixed
+// power or to a share of the installed peak power of the site, e.g. 70% or 0%
+// for zero-export installations.
+type FeedInLimitConfig struct {
+	Watts   *float64 `json:"watts,omitempty"`
+	Percent *float64 `json:"percent,omitempty"`
+	// Tolerance is the power in W the limit may be exceeded by without
+	// counting as a violation.
+	Tolerance float64 `json:"tolerance_w,omitempty"`
+}
+
+func (l *FeedInLimitConfig) validate(site SiteConfig) error {
+	if (l.Watts == nil) == (l.Percent == nil) {
+		return fmt.Errorf("either watts or percent has to be given")
+	}
+	if l.Watts != nil && *l.Watts < 0 {
+		return fmt.Errorf("negative limit given")
+	}
+	if l.Percent != nil {
+		if *l.Percent < 0 || *l.Percent > 100 {
+			return fmt.Errorf("percent %v not between 0 and 100", *l.Percent)
+		}
+		if site.PeakPower <= 0 {
+			return fmt.Errorf("percent given without peak power of the site")
+		}
+	}
+	if l.Tolerance < 0 {
+		return fmt.Errorf("negative tolerance given")
+	}
+	return nil
+}
+
+// limit returns the feed-in limit in W.
+func (l *FeedInLimitConfig) limit(site SiteConfig) float64 {
+	if l.Watts != nil {
+		return *l.Watts
+	}
+	return site.PeakPower * 1000 * *l.Percent / 100
+}
+
+// feedInLimitMonitor monitors the compliance of sites with their feed-in
+// limit.
+type feedInLimitMonitor struct {
+	mu          sync.Mutex
+	violating   map[string]bool
+	config      *configStore
+	limit       *prometheus.GaugeVec
+	utilization *prometheus.GaugeVec
+	violations  *prometheus.CounterVec
+}
+
+func newFeedInLimitMonitor(reg *prometheus.Registry, config *configStore) *feedInLimitMonitor {
+	m := &feedInLimitMonitor{
+		violating: make(map[string]bool),
+		config:    config,
+		limit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "feed_in_limit_watts",
+				Help:      "Configured limit of the power exported to the grid",
+			},
+			[]string{"site"},
+		),
+		utilization: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "feed_in_limit_utilization_ratio",
+				Help:      "Power currently exported to the grid relative to the feed-in limit",
+			},
+			[]string{"site"},
+		),
+		violations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ntuity",
+				Name:      "feed_in_limit_violations_total",
+				Help:      "Number of times the power exported to the grid exceeded the feed-in limit",
+			},
+			[]string{"site"},
+		),
+	}
+
+	reg.MustRegister(m.limit, m.utilization, m.violations)
+
+	config.onRemoveSite(func(site string) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.violating, site)
+		m.delete(site)
+	})
+
+	return m
+}
+
+func (m *feedInLimitMonitor) delete(site string) {
+	m.limit.DeleteLabelValues(site)
+	m.utilization.DeleteLabelValues(site)
+	m.violations.DeleteLabelValues(site)
+}
+
+func (m *feedInLimitMonitor) observe(site string, flow *EnergyFlow) {
+	siteConfig, ok := m.config.get().site(site)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !ok || siteConfig.FeedInLimit == nil {
+		delete(m.violating, site)
+		m.delete(site)
+		return
+	}
+
+	limit := siteConfig.FeedInLimit.limit(siteConfig)
+	export := positive(-flow.PowerGrid.float())
+
+	m.limit.WithLabelValues(site).Set(limit)
+	if limit > 0 {
+		m.utilization.WithLabelValues(site).Set(export / limit)
+	} else {
+		m.utilization.DeleteLabelValues(site)
+	}
+
+	// Make sure the counter is exported before the first violation.
+	m.violations.WithLabelValues(site).Add(0)
+
+	violating := export > limit+siteConfig.FeedInLimit.Tolerance
+	if violating && !m.violating[site] {
+		logWarning("Feed-in limit of %g W exceeded by site %s: %g W", limit, site, export)
+		m.violations.WithLabelValues(site).Inc()
+	}
+	m.violating[site] = violating
+}
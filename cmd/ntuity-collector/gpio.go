@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// gpioPath is the sysfs directory of the GPIO pins.
+const gpioPath = "/sys/class/gpio"
+
+// GPIOConfig is a GPIO pin driving an output through the sysfs interface,
+// e.g. the relay of an SG-Ready contact on a Raspberry Pi. The pin is the
+// sysfs number, which may be offset by the base of the GPIO chip on newer
+// kernels.
+type GPIOConfig struct {
+	Pin int `json:"pin"`
+	// ActiveLow inverts the pin for relays switching on a low level.
+	ActiveLow bool `json:"active_low,omitempty"`
+}
+
+func (g *GPIOConfig) String() string {
+	return fmt.Sprintf("gpio%d", g.Pin)
+}
+
+// export makes the pin available in sysfs and configures it as output.
+func (g *GPIOConfig) export() error {
+	dir := filepath.Join(gpioPath, g.String())
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(filepath.Join(gpioPath, "export"), []byte(fmt.Sprint(g.Pin)), 0); err != nil {
+			return fmt.Errorf("failed to export %s: %v", g, err)
+		}
+	}
+
+	activeLow := "0"
+	if g.ActiveLow {
+		activeLow = "1"
+	}
+
+	// udev may need a moment to grant access to a freshly exported pin.
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = ioutil.WriteFile(filepath.Join(dir, "active_low"), []byte(activeLow), 0); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to configure %s: %v", g, err)
+	}
+
+	direction, err := ioutil.ReadFile(filepath.Join(dir, "direction"))
+	if err != nil {
+		return err
+	}
+	if string(direction) == "out\n" {
+		return nil
+	}
+
+	// Setting the direction to low makes the pin an output which is off.
+	return ioutil.WriteFile(filepath.Join(dir, "direction"), []byte("low"), 0)
+}
+
+func (g *GPIOConfig) set(on bool) error {
+	if err := g.export(); err != nil {
+		return err
+	}
+
+	value := "0"
+	if on {
+		value = "1"
+	}
+	return ioutil.WriteFile(filepath.Join(gpioPath, g.String(), "value"), []byte(value), 0)
+}
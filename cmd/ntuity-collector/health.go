@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// registerHealthHandlers registers /healthz, which reports the collector to
+// be running, and /readyz, which reports whether it's polling sites.
+func registerHealthHandlers(p *poller) {
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "OK\n")
+	})
+
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !p.ready() {
+			http.Error(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "OK\n")
+	})
+}
+
+// runHealthcheck queries the /readyz endpoint of the local collector, so
+// container images can declare a health check without shipping curl.
+func runHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	listenAddress := fs.String("listen-address", ":8080", "The address the collector listens on for HTTP requests.")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout of the health check")
+	fs.Parse(args)
+
+	address := *listenAddress
+	if strings.HasPrefix(address, ":") {
+		address = "127.0.0.1" + address
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	res, err := client.Get(fmt.Sprintf("http://%s/readyz", address))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to check health: %v\n", err)
+		return 1
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Collector not ready: status %d\n", res.StatusCode)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+var heartbeatClient = &http.Client{Timeout: 10 * time.Second}
+
+// sendHeartbeat pings a dead man's switch like healthchecks.io to signal a
+// successful poll cycle.
+func sendHeartbeat(url string) {
+	res, err := heartbeatClient.Get(url)
+	if err != nil {
+		logError("Failed to send heartbeat: %v", err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		logError("Failed to send heartbeat: unexpected response status %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// heatingDegreeDays exports the heating degree days of the sites with a
+// configured location and normalizes their heating energy by them, so that
+// the heating consumption of cold and mild periods can be compared.
+type heatingDegreeDays struct {
+	config  *configStore
+	energy  *energyCounters
+	weather *weatherTracker
+
+	totalDesc      *prometheus.Desc
+	todayDesc      *prometheus.Desc
+	monthDesc      *prometheus.Desc
+	normalizedDesc *prometheus.Desc
+}
+
+func newHeatingDegreeDays(reg *prometheus.Registry, config *configStore, energy *energyCounters, weather *weatherTracker) *heatingDegreeDays {
+	h := &heatingDegreeDays{
+		config:  config,
+		energy:  energy,
+		weather: weather,
+		totalDesc: prometheus.NewDesc(
+			"ntuity_heating_degree_days_total",
+			"Heating degree days, i.e. the time integral of the difference between the heating base temperature and the outdoor temperature while below it",
+			[]string{"site"}, nil,
+		),
+		todayDesc: prometheus.NewDesc(
+			"ntuity_heating_degree_days_today",
+			"Heating degree days since midnight",
+			[]string{"site"}, nil,
+		),
+		monthDesc: prometheus.NewDesc(
+			"ntuity_heating_degree_days_month",
+			"Heating degree days since the start of the month",
+			[]string{"site"}, nil,
+		),
+		normalizedDesc: prometheus.NewDesc(
+			"ntuity_heating_energy_month_wh_per_degree_day",
+			"Energy in Wh consumed by heatings since the start of the month per heating degree day",
+			[]string{"site"}, nil,
+		),
+	}
+
+	reg.MustRegister(h)
+
+	return h
+}
+
+func (h *heatingDegreeDays) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.totalDesc
+	ch <- h.todayDesc
+	ch <- h.monthDesc
+	ch <- h.normalizedDesc
+}
+
+func (h *heatingDegreeDays) Collect(ch chan<- prometheus.Metric) {
+	for _, site := range h.config.get().Sites {
+		total, today, month, ok := h.weather.degreeDays(site.ID)
+		if !ok {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(h.totalDesc, prometheus.CounterValue, total, site.ID)
+		ch <- prometheus.MustNewConstMetric(h.todayDesc, prometheus.GaugeValue, today, site.ID)
+		ch <- prometheus.MustNewConstMetric(h.monthDesc, prometheus.GaugeValue, month, site.ID)
+
+		// Below one degree day the ratio is dominated by hot water and noise.
+		heating, ok := h.energy.month(site.ID, "heating")
+		if !ok || month < 1 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(h.normalizedDesc, prometheus.GaugeValue, heating/month, site.ID)
+	}
+}
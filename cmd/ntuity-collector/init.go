@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// prompter asks the user for input on the terminal.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints the question and returns the trimmed answer or the default
+// value if the answer is empty.
+func (p *prompter) ask(question, def string) (string, error) {
+	if len(def) > 0 {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+
+	answer, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || len(answer) == 0) {
+		return "", err
+	}
+
+	answer = strings.TrimSpace(answer)
+	if len(answer) == 0 {
+		return def, nil
+	}
+	return answer, nil
+}
+
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	d := "y/N"
+	if def {
+		d = "Y/n"
+	}
+
+	answer, err := p.ask(question+" ("+d+")", "")
+	if err != nil {
+		return false, err
+	}
+
+	switch strings.ToLower(answer) {
+	case "":
+		return def, nil
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (p *prompter) askPrice(question string) (float64, error) {
+	for {
+		answer, err := p.ask(question, "")
+		if err != nil || len(answer) == 0 {
+			return 0, err
+		}
+
+		price, err := strconv.ParseFloat(answer, 64)
+		if err == nil && price >= 0 {
+			return price, nil
+		}
+		fmt.Fprintf(p.out, "Please enter a non-negative number.\n")
+	}
+}
+
+// selectSites asks which of the sites to collect metrics for.
+func (p *prompter) selectSites(sites []Site) ([]Site, error) {
+	for i, site := range sites {
+		fmt.Fprintf(p.out, "  %d) %s (%s)\n", i+1, site.Name, site.ID)
+	}
+
+	for {
+		answer, err := p.ask("Sites to collect metrics for (comma separated numbers or \"all\")", "all")
+		if err != nil {
+			return nil, err
+		}
+
+		if answer == "all" {
+			return sites, nil
+		}
+
+		var selected []Site
+		valid := true
+		for _, f := range strings.Split(answer, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(f))
+			if err != nil || n < 1 || n > len(sites) {
+				valid = false
+				break
+			}
+			selected = append(selected, sites[n-1])
+		}
+
+		if valid && len(selected) > 0 {
+			return selected, nil
+		}
+		fmt.Fprintf(p.out, "Please enter numbers between 1 and %d.\n", len(sites))
+	}
+}
+
+// runInit interactively creates a configuration file.
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("config-file", "ntuity-collector.json", "Path of the configuration file to write")
+	fs.Parse(args)
+
+	if err := initConfig(*output, &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create configuration: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func initConfig(path string, p *prompter) error {
+	if _, err := os.Stat(path); err == nil {
+		overwrite, err := p.confirm(fmt.Sprintf("%s already exists. Overwrite it?", path), false)
+		if err != nil {
+			return err
+		}
+		if !overwrite {
+			return fmt.Errorf("%s already exists", path)
+		}
+	}
+
+	apiKey, err := p.ask("API key", os.Getenv("NTUITY_API_KEY"))
+	if err != nil {
+		return err
+	}
+	if len(apiKey) == 0 {
+		return fmt.Errorf("no api key given")
+	}
+
+	fmt.Fprintf(p.out, "Retrieving sites...\n")
+	sites, err := retrieveSites(apiKey)
+	if err != nil {
+		return fmt.Errorf("failed to list sites: %v", err)
+	}
+	if len(sites) == 0 {
+		return fmt.Errorf("no sites accessible with the API key")
+	}
+
+	selected, err := p.selectSites(sites)
+	if err != nil {
+		return err
+	}
+
+	cfg := &Config{APIKey: apiKey}
+	for _, site := range selected {
+		siteConfig := SiteConfig{ID: site.ID, Timezone: site.Timezone}
+
+		fmt.Fprintf(p.out, "Energy prices for %s (leave empty to skip):\n", site.Name)
+		importPrice, err := p.askPrice("  Price per kWh imported from the grid")
+		if err != nil {
+			return err
+		}
+		if importPrice > 0 {
+			exportPrice, err := p.askPrice("  Price per kWh exported to the grid")
+			if err != nil {
+				return err
+			}
+			siteConfig.Prices = &PriceConfig{Import: importPrice, Export: exportPrice}
+		}
+
+		cfg.Sites = append(cfg.Sites, siteConfig)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	storeKey, err := p.confirm("Store the API key in the configuration file? Otherwise it's read from $NTUITY_API_KEY", false)
+	if err != nil {
+		return err
+	}
+	if !storeKey {
+		cfg.APIKey = "${NTUITY_API_KEY}"
+	}
+
+	bs, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, append(bs, '\n'), 0600); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(p.out, "Wrote %s. Start the collector with:\n\n", path)
+	fmt.Fprintf(p.out, "    ntuity-collector -config-file %s\n", path)
+
+	return nil
+}
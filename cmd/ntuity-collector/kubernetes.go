@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials of the service account of a pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// sitesConfigMapKey is the key of the site definitions in a ConfigMap.
+const sitesConfigMapKey = "sites.json"
+
+// kubeClient is a minimal client of the Kubernetes API using the service
+// account of the pod the collector runs in.
+type kubeClient struct {
+	baseURL   string
+	namespace string
+	client    *http.Client
+}
+
+func newInClusterKubeClient(namespace string) (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 || len(port) == 0 {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid CA certificate of the cluster")
+	}
+
+	if len(namespace) == 0 {
+		ns, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	return &kubeClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// get retrieves a resource of the namespace, e.g. "configmaps/sites".
+func (k *kubeClient) get(group, resource string, v interface{}) error {
+	// The token is read for every request, as bound service account tokens
+	// are rotated while the pod runs.
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s/namespaces/%s/%s", k.baseURL, group, k.namespace, resource), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %d for %s", res.StatusCode, resource)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// kubeSiteSpec defines a site, either as spec of an NtuitySite resource or
+// as entry of the site definitions in a ConfigMap.
+type kubeSiteSpec struct {
+	SiteID          string            `json:"siteId"`
+	APIKeySecretRef *secretKeyRef     `json:"apiKeySecretRef,omitempty"`
+	Timezone        string            `json:"timezone,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// secretKeyRef references a key of a Secret in the namespace.
+type secretKeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// kubeSiteSource discovers sites from NtuitySite resources or a ConfigMap.
+type kubeSiteSource struct {
+	client *kubeClient
+	// configMap is the name of the ConfigMap with the site definitions. If
+	// empty, NtuitySite resources are used.
+	configMap string
+	// rejected are the last sites which couldn't be applied, to record the
+	// failure only once.
+	rejected []SiteConfig
+}
+
+// newKubeSiteSource parses the source of sites given as "ntuitysites" or
+// "configmap/<name>".
+func newKubeSiteSource(source, namespace string) (*kubeSiteSource, error) {
+	var configMap string
+	switch {
+	case source == "ntuitysites":
+	case strings.HasPrefix(source, "configmap/") && len(source) > len("configmap/"):
+		configMap = strings.TrimPrefix(source, "configmap/")
+	default:
+		return nil, fmt.Errorf("unknown source %q", source)
+	}
+
+	client, err := newInClusterKubeClient(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubeSiteSource{client: client, configMap: configMap}, nil
+}
+
+func (s *kubeSiteSource) specs() ([]kubeSiteSpec, error) {
+	if len(s.configMap) > 0 {
+		var configMap struct {
+			Data map[string]string `json:"data"`
+		}
+		if err := s.client.get("api/v1", "configmaps/"+s.configMap, &configMap); err != nil {
+			return nil, err
+		}
+
+		var specs []kubeSiteSpec
+		if err := json.Unmarshal([]byte(configMap.Data[sitesConfigMapKey]), &specs); err != nil {
+			return nil, fmt.Errorf("failed to parse %s of ConfigMap %s: %v", sitesConfigMapKey, s.configMap, err)
+		}
+		return specs, nil
+	}
+
+	var list struct {
+		Items []struct {
+			Spec kubeSiteSpec `json:"spec"`
+		} `json:"items"`
+	}
+	if err := s.client.get("apis/ntuity.io/v1alpha1", "ntuitysites", &list); err != nil {
+		return nil, err
+	}
+
+	var specs []kubeSiteSpec
+	for _, item := range list.Items {
+		specs = append(specs, item.Spec)
+	}
+	return specs, nil
+}
+
+// sites returns the configuration of the discovered sites with the API keys
+// read from their secrets.
+func (s *kubeSiteSource) sites() ([]SiteConfig, error) {
+	specs, err := s.specs()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]map[string][]byte)
+	var sites []SiteConfig
+	for _, spec := range specs {
+		if err := validateSiteLabels(spec.Labels); err != nil {
+			return nil, fmt.Errorf("invalid labels of site %s: %v", spec.SiteID, err)
+		}
+		site := SiteConfig{ID: spec.SiteID, Timezone: spec.Timezone, Labels: spec.Labels}
+
+		if ref := spec.APIKeySecretRef; ref != nil {
+			data, ok := secrets[ref.Name]
+			if !ok {
+				var secret struct {
+					Data map[string][]byte `json:"data"`
+				}
+				if err := s.client.get("api/v1", "secrets/"+ref.Name, &secret); err != nil {
+					return nil, fmt.Errorf("failed to read API key of site %s: %v", spec.SiteID, err)
+				}
+				data = secret.Data
+				secrets[ref.Name] = data
+			}
+
+			key, ok := data[ref.Key]
+			if !ok {
+				return nil, fmt.Errorf("no key %s in secret %s of site %s", ref.Key, ref.Name, spec.SiteID)
+			}
+			site.APIKey = strings.TrimSpace(string(key))
+		}
+
+		sites = append(sites, site)
+	}
+
+	return sites, nil
+}
+
+// reconcile updates the dynamic sites of the configuration if they changed.
+// Added and removed sites and rotated API keys are recorded in the audit log.
+func (s *kubeSiteSource) reconcile(config *configStore, audit *auditLog, previous []SiteConfig) []SiteConfig {
+	sites, err := s.sites()
+	if err != nil {
+		logError("Failed to retrieve sites from Kubernetes: %v", err)
+		return previous
+	}
+	if reflect.DeepEqual(sites, previous) {
+		return previous
+	}
+
+	old := config.get()
+	if err := config.setDynamicSites(sites); err != nil {
+		logError("Failed to apply sites from Kubernetes: %v", err)
+		if !reflect.DeepEqual(sites, s.rejected) {
+			s.rejected = sites
+			audit.record(auditEntry{Action: "reconcile_sites", Client: "kubernetes", Outcome: "failure", Details: []string{err.Error()}})
+		}
+		return previous
+	}
+
+	logInfo("Reconciled %d sites from Kubernetes", len(sites))
+
+	cfg := config.get()
+	added, removed := changedSites(old, cfg)
+	for _, site := range added {
+		audit.record(auditEntry{Action: "add_site", Client: "kubernetes", Site: site, Outcome: "success"})
+	}
+	for _, site := range removed {
+		audit.record(auditEntry{Action: "remove_site", Client: "kubernetes", Site: site, Outcome: "success"})
+	}
+	if rotated := rotatedAPIKeys(old, cfg); len(rotated) > 0 {
+		audit.record(auditEntry{Action: "rotate_api_keys", Client: "kubernetes", Outcome: "success", Details: rotated})
+	}
+
+	return sites
+}
+
+// watch reconciles the sites in every poll interval.
+func (s *kubeSiteSource) watch(config *configStore, audit *auditLog, reporter *errorReporter, sites []SiteConfig) {
+	defer reporter.recoverPanic("")
+	for {
+		time.Sleep(pollInterval)
+		sites = s.reconcile(config, audit, sites)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	logIdentifier = "ntuity-collector"
+	journalSocket = "/run/systemd/journal/socket"
+)
+
+// Syslog priorities as used by journald and syslog.
+const (
+	priorityErr     = 3
+	priorityWarning = 4
+	priorityInfo    = 6
+)
+
+// priorityWriter is implemented by log outputs which record the priority of
+// messages. Messages written by the log package directly, e.g. the ones of
+// libraries, are informational.
+type priorityWriter interface {
+	writePriority(priority int, msg string) error
+}
+
+// logMessage logs a message with the given priority.
+func logMessage(priority int, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if w, ok := log.Writer().(priorityWriter); ok {
+		w.writePriority(priority, msg)
+		return
+	}
+	log.Output(3, msg)
+}
+
+func logError(format string, v ...interface{}) {
+	logMessage(priorityErr, format, v...)
+}
+
+func logWarning(format string, v ...interface{}) {
+	logMessage(priorityWarning, format, v...)
+}
+
+func logInfo(format string, v ...interface{}) {
+	logMessage(priorityInfo, format, v...)
+}
+
+// setupLogging redirects the log output to the given target.
+func setupLogging(output, syslogAddress string) error {
+	switch output {
+	case "stderr":
+		return nil
+	case "journald":
+		w, err := newJournalWriter()
+		if err != nil {
+			return err
+		}
+		log.SetFlags(0)
+		log.SetOutput(w)
+	case "syslog":
+		network, raddr := "", ""
+		if len(syslogAddress) > 0 {
+			u, err := url.Parse(syslogAddress)
+			if err != nil {
+				return fmt.Errorf("invalid syslog address %q: %v", syslogAddress, err)
+			}
+			network, raddr = u.Scheme, u.Host
+		}
+
+		w, err := newSyslogWriter(network, raddr)
+		if err != nil {
+			return err
+		}
+		log.SetFlags(0)
+		log.SetOutput(w)
+	default:
+		return fmt.Errorf("unknown log output %q", output)
+	}
+
+	return nil
+}
+
+// journalWriter sends log messages to systemd-journald using its native
+// protocol.
+type journalWriter struct {
+	conn net.Conn
+}
+
+func newJournalWriter() (*journalWriter, error) {
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &journalWriter{conn: conn}, nil
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	if err := w.writePriority(priorityInfo, strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *journalWriter) writePriority(priority int, msg string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "PRIORITY=%d\n", priority)
+	fmt.Fprintf(&buf, "SYSLOG_IDENTIFIER=%s\n", logIdentifier)
+
+	// Values containing newlines have to be sent with an explicit length.
+	if strings.Contains(msg, "\n") {
+		buf.WriteString("MESSAGE\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(msg)))
+		buf.WriteString(msg)
+		buf.WriteString("\n")
+	} else {
+		fmt.Fprintf(&buf, "MESSAGE=%s\n", msg)
+	}
+
+	_, err := w.conn.Write(buf.Bytes())
+	return err
+}
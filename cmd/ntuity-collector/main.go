@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,11 +19,36 @@ import (
 )
 
 const (
-	baseURL = "https://api.ntuity.io/v1/sites/%s/energy-flow/latest"
+	baseURL       = "https://api.ntuity.io/v1/sites/%s/energy-flow/latest"
+	pricesURL     = "https://api.ntuity.io/v1/sites/%s/energy-prices/latest"
+	devicesURL    = "https://api.ntuity.io/v1/sites/%s/%s"
+	deviceFlowURL = "https://api.ntuity.io/v1/sites/%s/%s/%s/energy-flow/latest"
+	chargingURL   = "https://api.ntuity.io/v1/sites/%s/charging-points/%s/charging-state/latest"
+	statusURL     = "https://api.ntuity.io/v1/sites/%s/status"
+	sitesURL      = "https://api.ntuity.io/v1/sites"
 )
 
 var addr = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
-var siteID = flag.String("site-id", "", "The ID of the site to collect metrics for")
+var siteID = flag.String("site-id", "", "The ID of the site to collect metrics for (comma separated for multiple sites)")
+var configFile = flag.String("config-file", "", "Path to a JSON file describing the sites to collect metrics for")
+var enableAdminAPI = flag.Bool("enable-admin-api", false, "Enable the admin API endpoints below /api/v1/admin/")
+var adminUsername = flag.String("admin-username", "admin", "User name required by the admin API and the lifecycle endpoints, whose password is read from the NTUITY_ADMIN_PASSWORD environment variable")
+var enableEvccAPI = flag.Bool("enable-evcc-api", false, "Enable endpoints below /evcc/ serving the latest values of each site for evcc's custom meter plugin")
+var auditLogFile = flag.String("audit-log", "", "Path to a file to append an entry for every call of the admin and lifecycle endpoints and every change of the sites discovered from Kubernetes to")
+var enableLifecycle = flag.Bool("enable-lifecycle", false, "Enable shutdown and reload via HTTP requests to /-/quit and /-/reload")
+var socBands = flag.String("soc-bands", "10,90", "Comma separated, strictly ascending state of charge bounds (in percent) of the bands to track the time spent in")
+var collectDevicePower = flag.Bool("collect-device-power", false, "Collect the power of every single consumer device (requires one API request per device and poll)")
+var collectChargingState = flag.Bool("collect-charging-state", false, "Collect the vehicle state of charge, plug status and charging current of every charging point (requires one API request per charging point and poll)")
+var logOutput = flag.String("log-output", "stderr", "Where to write log messages to: stderr, journald or syslog")
+var syslogAddress = flag.String("syslog-address", "", "Address of a remote syslog daemon, e.g. udp://logs.example.com:514 (the local one is used if empty)")
+var sentryDSN = flag.String("sentry-dsn", "", "DSN of a Sentry compatible service to report panics and repeated poll failures to")
+var sentryFailureThreshold = flag.Int("sentry-failure-threshold", 5, "Number of failed polls of a site in a row before reporting it")
+var heartbeatURL = flag.String("heartbeat-url", "", "URL to ping after every poll cycle in which all sites were polled successfully, e.g. of healthchecks.io")
+var localStoragePath = flag.String("local-storage-path", "", "Directory to keep the samples of all metrics in, served through the Prometheus remote-read API at /api/v1/read")
+var localStorageRetention = flag.Duration("local-storage-retention", 15*24*time.Hour, "How long to keep samples in the local storage")
+var kubernetesSites = flag.String("kubernetes-sites", "", "Discover sites from NtuitySite resources (ntuitysites) or a ConfigMap (configmap/<name>) in the Kubernetes namespace of the collector")
+var kubernetesNamespace = flag.String("kubernetes-namespace", "", "Kubernetes namespace to discover sites in instead of the one of the collector")
+var stateFile = flag.String("state-file", "", "Path to a file to persist derived counters across restarts in")
 
 type MetricValue struct {
 	Value *float64  `json:"value"`
@@ -51,219 +80,508 @@ type EnergyFlow struct {
 	GridsOnlineCount          int         `json:"grids_online_count"`
 }
 
-func retrieveEnergyFlow(siteURL, apiKey string) (*EnergyFlow, error) {
-	req, _ := http.NewRequest("GET", siteURL, nil)
+// float returns the value or 0 if no value was reported.
+func (v MetricValue) float() float64 {
+	if v.Value == nil {
+		return 0
+	}
+	return *v.Value
+}
+
+// timestamp returns the time of the most recent value in the energy flow.
+func (f *EnergyFlow) timestamp() time.Time {
+	var t time.Time
+	for _, v := range []MetricValue{
+		f.PowerConsumption,
+		f.PowerConsumptionCalc,
+		f.PowerProduction,
+		f.PowerStorage,
+		f.PowerGrid,
+		f.PowerChargingstations,
+		f.PowerHeating,
+		f.PowerAppliances,
+		f.StateOfCharge,
+		f.SelfSufficiency,
+	} {
+		if v.Time.After(t) {
+			t = v.Time
+		}
+	}
+	return t
+}
+
+// apiError is returned for responses of the API with a status other than
+// 200 OK.
+type apiError struct {
+	StatusCode int
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("unexpected response status %d", e.StatusCode)
+}
+
+// isNotAvailable reports whether the error indicates an endpoint which isn't
+// available for the site or account.
+func isNotAvailable(err error) bool {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusForbidden
+}
+
+// retrieve fetches the given URL from the API and decodes the JSON response
+// into v. The outcome is tracked in the availability of the endpoint.
+func retrieve(endpoint, url, apiKey string, v interface{}) error {
+	return retrieveWithClient(http.DefaultClient, endpoint, url, apiKey, v)
+}
+
+// retrieveWithClient is like retrieve, sending the request with the given
+// client.
+func retrieveWithClient(client *http.Client, endpoint, url, apiKey string, v interface{}) error {
+	req, _ := http.NewRequest("GET", url, nil)
 	req.Header.Add("accept", "application/json")
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		apiAvailability.record(endpoint, false)
+		return err
 	}
 	defer res.Body.Close()
 
+	apiAvailability.record(endpoint, res.StatusCode < http.StatusInternalServerError)
+
+	if res.StatusCode != http.StatusOK {
+		return &apiError{StatusCode: res.StatusCode}
+	}
+
 	bs, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	return json.Unmarshal(bs, v)
+}
+
+func retrieveEnergyFlow(client *http.Client, siteURL, apiKey string) (*EnergyFlow, error) {
 	var flow EnergyFlow
-	if err := json.Unmarshal(bs, &flow); err != nil {
+	if err := retrieveWithClient(client, "energy_flow", siteURL, apiKey, &flow); err != nil {
 		return nil, err
 	}
 
 	return &flow, nil
 }
 
-func startNtuityMetricsCollector(reg *prometheus.Registry) error {
-	apiKey := os.Getenv("NTUITY_API_KEY")
-	if len(apiKey) == 0 {
-		return fmt.Errorf("no api key given")
-	}
-
-	siteURL := fmt.Sprintf(baseURL, *siteID)
-
-	powerConsumption := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "power_consumption",
-			Help:      "Power of all consumers, e.g. Appliances, CPs, HPs",
-		},
-		[]string{"site"},
-	)
-
-	powerConsumptionCalc := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "power_consumption_calc",
-			Help:      "Calculated power of all consumers, e.g. Appliances, CPs, HPs",
-		},
-		[]string{"site"},
-	)
-
-	powerProduction := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "power_production",
-			Help:      "Power of all producers, e.g. PVs",
-		},
-		[]string{"site"},
-	)
-
-	powerStorage := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "power_storage",
-			Help:      "Power from + (=discharching) or to - (=charging) the storages",
-		},
-		[]string{"site"},
-	)
-
-	powerGrid := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "power_grid",
-			Help:      "Power from + or to - the grid",
-		},
-		[]string{"site"},
-	)
-
-	powerChargingStations := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "power_charging_stations",
-			Help:      "Power from + or to - the grid",
-		},
-		[]string{"site"},
-	)
-
-	powerHeating := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "power_heating",
-			Help:      "Power of all heating devices",
-		},
-		[]string{"site"},
-	)
-
-	powerAppliances := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "power_appliances",
-			Help:      "Power of all appliances (difference between total consumption and sum of all other sub-consumer)",
-		},
-		[]string{"site"},
-	)
-
-	stateOfCharge := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "state_of_charge",
-			Help:      "State of charge of all storages",
-		},
-		[]string{"site"},
-	)
-
-	selfSufficiency := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: "ntuity",
-			Name:      "self_sufficiency",
-			Help:      "A performance or fitness value about the current energy flow (based on power)",
-		},
-		[]string{"site"},
-	)
+// energyFlowMetrics holds the gauges exported for the latest energy flow of
+// each site.
+type energyFlowMetrics struct {
+	powerConsumption      *prometheus.GaugeVec
+	powerConsumptionCalc  *prometheus.GaugeVec
+	powerProduction       *prometheus.GaugeVec
+	powerStorage          *prometheus.GaugeVec
+	powerGrid             *prometheus.GaugeVec
+	powerChargingStations *prometheus.GaugeVec
+	powerHeating          *prometheus.GaugeVec
+	powerAppliances       *prometheus.GaugeVec
+	stateOfCharge         *prometheus.GaugeVec
+	selfSufficiency       *prometheus.GaugeVec
+}
+
+func newEnergyFlowMetrics(reg *prometheus.Registry, config *configStore) *energyFlowMetrics {
+	m := &energyFlowMetrics{
+		powerConsumption: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "power_consumption",
+				Help:      "Power of all consumers, e.g. Appliances, CPs, HPs",
+			},
+			[]string{"site"},
+		),
+
+		powerConsumptionCalc: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "power_consumption_calc",
+				Help:      "Calculated power of all consumers, e.g. Appliances, CPs, HPs",
+			},
+			[]string{"site"},
+		),
+
+		powerProduction: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "power_production",
+				Help:      "Power of all producers, e.g. PVs",
+			},
+			[]string{"site"},
+		),
+
+		powerStorage: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "power_storage",
+				Help:      "Power from + (=discharching) or to - (=charging) the storages",
+			},
+			[]string{"site"},
+		),
+
+		powerGrid: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "power_grid",
+				Help:      "Power from + or to - the grid",
+			},
+			[]string{"site"},
+		),
+
+		powerChargingStations: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "power_charging_stations",
+				Help:      "Power from + or to - the grid",
+			},
+			[]string{"site"},
+		),
+
+		powerHeating: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "power_heating",
+				Help:      "Power of all heating devices",
+			},
+			[]string{"site"},
+		),
+
+		powerAppliances: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "power_appliances",
+				Help:      "Power of all appliances (difference between total consumption and sum of all other sub-consumer)",
+			},
+			[]string{"site"},
+		),
+
+		stateOfCharge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "state_of_charge",
+				Help:      "State of charge of all storages",
+			},
+			[]string{"site"},
+		),
+
+		selfSufficiency: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "self_sufficiency",
+				Help:      "A performance or fitness value about the current energy flow (based on power)",
+			},
+			[]string{"site"},
+		),
+	}
 
 	reg.MustRegister(
-		powerConsumption,
-		powerConsumptionCalc,
-		powerProduction,
-		powerStorage,
-		powerGrid,
-		powerChargingStations,
-		powerHeating,
-		powerAppliances,
-		stateOfCharge,
-		selfSufficiency)
+		m.powerConsumption,
+		m.powerConsumptionCalc,
+		m.powerProduction,
+		m.powerStorage,
+		m.powerGrid,
+		m.powerChargingStations,
+		m.powerHeating,
+		m.powerAppliances,
+		m.stateOfCharge,
+		m.selfSufficiency)
+
+	config.onRemoveSite(m.delete)
+
+	return m
+}
 
-	go func() {
-		for {
-			flow, err := retrieveEnergyFlow(siteURL, apiKey)
-			if err != nil {
-				log.Printf("Failed to collect metrics: %v", err)
-				os.Exit(1)
-			}
-
-			if flow.PowerConsumptionCalc.Value != nil {
-				powerConsumptionCalc.WithLabelValues(*siteID).Set(float64(*flow.PowerConsumptionCalc.Value))
-			} else {
-				powerConsumptionCalc.WithLabelValues(*siteID).Set(float64(0))
-			}
-			if flow.PowerProduction.Value != nil {
-				powerProduction.WithLabelValues(*siteID).Set(float64(*flow.PowerProduction.Value))
-			} else {
-				powerProduction.WithLabelValues(*siteID).Set(float64(0))
-			}
-			if flow.PowerStorage.Value != nil {
-				powerStorage.WithLabelValues(*siteID).Set(float64(*flow.PowerStorage.Value))
-			} else {
-				powerStorage.WithLabelValues(*siteID).Set(float64(0))
-			}
-			if flow.PowerGrid.Value != nil {
-				powerGrid.WithLabelValues(*siteID).Set(float64(*flow.PowerGrid.Value))
-			} else {
-				powerGrid.WithLabelValues(*siteID).Set(float64(0))
-			}
-			if flow.PowerChargingstations.Value != nil {
-				powerChargingStations.WithLabelValues(*siteID).Set(float64(*flow.PowerChargingstations.Value))
-			} else {
-				powerChargingStations.WithLabelValues(*siteID).Set(float64(0))
-			}
-			if flow.PowerHeating.Value != nil {
-				powerHeating.WithLabelValues(*siteID).Set(float64(*flow.PowerHeating.Value))
-			} else {
-				powerHeating.WithLabelValues(*siteID).Set(float64(0))
-			}
-			if flow.PowerAppliances.Value != nil {
-				powerAppliances.WithLabelValues(*siteID).Set(float64(*flow.PowerAppliances.Value))
-			} else {
-				powerAppliances.WithLabelValues(*siteID).Set(float64(0))
-			}
-			if flow.StateOfCharge.Value != nil {
-				stateOfCharge.WithLabelValues(*siteID).Set(float64(*flow.StateOfCharge.Value))
-			} else {
-				stateOfCharge.WithLabelValues(*siteID).Set(float64(0))
-			}
-			if flow.SelfSufficiency.Value != nil {
-				selfSufficiency.WithLabelValues(*siteID).Set(float64(*flow.SelfSufficiency.Value))
-			} else {
-				selfSufficiency.WithLabelValues(*siteID).Set(float64(0))
-			}
-
-			time.Sleep(time.Second * 60)
-		}
-	}()
+func (m *energyFlowMetrics) observe(site string, flow *EnergyFlow) {
+	if flow.PowerConsumptionCalc.Value != nil {
+		m.powerConsumptionCalc.WithLabelValues(site).Set(float64(*flow.PowerConsumptionCalc.Value))
+	} else {
+		m.powerConsumptionCalc.WithLabelValues(site).Set(float64(0))
+	}
+	if flow.PowerProduction.Value != nil {
+		m.powerProduction.WithLabelValues(site).Set(float64(*flow.PowerProduction.Value))
+	} else {
+		m.powerProduction.WithLabelValues(site).Set(float64(0))
+	}
+	if flow.PowerStorage.Value != nil {
+		m.powerStorage.WithLabelValues(site).Set(float64(*flow.PowerStorage.Value))
+	} else {
+		m.powerStorage.WithLabelValues(site).Set(float64(0))
+	}
+	if flow.PowerGrid.Value != nil {
+		m.powerGrid.WithLabelValues(site).Set(float64(*flow.PowerGrid.Value))
+	} else {
+		m.powerGrid.WithLabelValues(site).Set(float64(0))
+	}
+	if flow.PowerChargingstations.Value != nil {
+		m.powerChargingStations.WithLabelValues(site).Set(float64(*flow.PowerChargingstations.Value))
+	} else {
+		m.powerChargingStations.WithLabelValues(site).Set(float64(0))
+	}
+	if flow.PowerHeating.Value != nil {
+		m.powerHeating.WithLabelValues(site).Set(float64(*flow.PowerHeating.Value))
+	} else {
+		m.powerHeating.WithLabelValues(site).Set(float64(0))
+	}
+	if flow.PowerAppliances.Value != nil {
+		m.powerAppliances.WithLabelValues(site).Set(float64(*flow.PowerAppliances.Value))
+	} else {
+		m.powerAppliances.WithLabelValues(site).Set(float64(0))
+	}
+	if flow.StateOfCharge.Value != nil {
+		m.stateOfCharge.WithLabelValues(site).Set(float64(*flow.StateOfCharge.Value))
+	} else {
+		m.stateOfCharge.WithLabelValues(site).Set(float64(0))
+	}
+	if flow.SelfSufficiency.Value != nil {
+		m.selfSufficiency.WithLabelValues(site).Set(float64(*flow.SelfSufficiency.Value))
+	} else {
+		m.selfSufficiency.WithLabelValues(site).Set(float64(0))
+	}
+}
+
+// delete removes the metrics of a site which is no longer collected.
+func (m *energyFlowMetrics) delete(site string) {
+	m.powerConsumption.DeleteLabelValues(site)
+	m.powerConsumptionCalc.DeleteLabelValues(site)
+	m.powerProduction.DeleteLabelValues(site)
+	m.powerStorage.DeleteLabelValues(site)
+	m.powerGrid.DeleteLabelValues(site)
+	m.powerChargingStations.DeleteLabelValues(site)
+	m.powerHeating.DeleteLabelValues(site)
+	m.powerAppliances.DeleteLabelValues(site)
+	m.stateOfCharge.DeleteLabelValues(site)
+	m.selfSufficiency.DeleteLabelValues(site)
+}
 
-	return nil
+// pipeline holds the components processing the energy flows of the sites.
+type pipeline struct {
+	paused    *pausedSites
+	outputs   *outputController
+	flows     *latestFlows
+	observers []flowObserver
+	persisted []stateful
+}
+
+// newPipeline sets up the components processing the energy flows and
+// registers their metrics.
+func newPipeline(reg *prometheus.Registry, config *configStore, bounds []float64) *pipeline {
+	paused := newPausedSites(reg, config)
+	metrics := newEnergyFlowMetrics(reg, config)
+	energy := newEnergyCounters(reg, config)
+	bands := newSoCBandTracker(reg, config, bounds)
+	outages := newOutageDetector(reg, config)
+	devices := newDeviceMetrics(reg, config)
+	tariffs := newTariffCounters(reg, config)
+	prices := newPriceTracker(reg, config)
+	status := newSiteStatusCollector(reg, config)
+	newSiteLabels(reg, config)
+	storage := newStorageEstimator(reg, config)
+	weather := newWeatherTracker(reg, config)
+	newPVPerformance(reg, config, energy, weather)
+	newHeatingDegreeDays(reg, config, energy, weather)
+	baseline := newConsumptionBaseline(reg, config)
+	feedIn := newFeedInLimitMonitor(reg, config)
+	outputs := newOutputController(reg, config)
+	flows := newLatestFlows(config)
+
+	reg.MustRegister(apiAvailability)
+
+	return &pipeline{
+		paused:    paused,
+		outputs:   outputs,
+		flows:     flows,
+		observers: []flowObserver{metrics, energy, bands, outages, devices, tariffs, prices, status, storage, weather, baseline, feedIn, outputs, flows},
+		persisted: []stateful{paused, energy, bands, tariffs, prices, weather, baseline, apiAvailability},
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "top":
+			os.Exit(runTop(os.Args[2:]))
+		case "healthcheck":
+			os.Exit(runHealthcheck(os.Args[2:]))
+		case "list-sites":
+			os.Exit(runListSites(os.Args[2:]))
+		case "query":
+			os.Exit(runQuery(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
-	if len(*siteID) == 0 {
-		log.Printf("No site ID given")
+	if err := setupLogging(*logOutput, *syslogAddress); err != nil {
+		logError("Failed to set up logging: %v", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		logError("Failed to load configuration: %v", err)
+		os.Exit(1)
+	}
+
+	config := newConfigStore(cfg)
+
+	var reporter *errorReporter
+	if len(*sentryDSN) > 0 {
+		reporter, err = newErrorReporter(*sentryDSN, *sentryFailureThreshold)
+		if err != nil {
+			logError("Failed to set up error reporting: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var audit *auditLog
+	if len(*auditLogFile) > 0 {
+		audit, err = newAuditLog(*auditLogFile)
+		if err != nil {
+			logError("Failed to open audit log: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// Sites from Kubernetes are discovered before setting up everything else
+	// so that their state is restored like the one of the other sites.
+	if len(*kubernetesSites) > 0 {
+		source, err := newKubeSiteSource(*kubernetesSites, *kubernetesNamespace)
+		if err != nil {
+			logError("Failed to set up discovery of sites from Kubernetes: %v", err)
+			os.Exit(1)
+		}
+		go source.watch(config, audit, reporter, source.reconcile(config, audit, nil))
+	}
+
+	bounds, err := parseSoCBands(*socBands)
+	if err != nil {
+		logError("Invalid state of charge bands: %v", err)
 		os.Exit(1)
 	}
 
 	reg := prometheus.NewRegistry()
+	pipe := newPipeline(reg, config, bounds)
+	lists := newDeviceLists(config)
+	if *collectDevicePower {
+		pipe.observers = append(pipe.observers, newDevicePowerCollector(reg, config, lists))
+	}
+	if *collectChargingState {
+		pipe.observers = append(pipe.observers, newChargingStateCollector(reg, config, lists))
+	}
+
+	persisted := pipe.persisted
+	if len(*stateFile) > 0 {
+		if err := restoreState(*stateFile, persisted); err != nil {
+			logError("Failed to restore state: %v", err)
+			os.Exit(1)
+		}
+		go persistState(*stateFile, persisted, reporter)
+	}
+
+	var tsdb *localStorage
+	if len(*localStoragePath) > 0 {
+		tsdb, err = openLocalStorage(*localStoragePath, *localStorageRetention)
+		if err != nil {
+			logError("Failed to open local storage: %v", err)
+			os.Exit(1)
+		}
+		registerRemoteReadHandler(tsdb)
+	}
 
 	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	registerTenantHandlers(reg, config, tsdb)
 
-	log.Printf("Listening on %s", *addr)
+	if (*enableAdminAPI || *enableLifecycle) && len(adminPassword()) == 0 {
+		logError("No admin password given in NTUITY_ADMIN_PASSWORD")
+		os.Exit(1)
+	}
 
-	if err := startNtuityMetricsCollector(reg); err != nil {
-		log.Printf("Failed to start metrics collector: %v", err)
+	if *enableAdminAPI {
+		registerAdminHandlers(config, pipe.paused, audit)
+	}
+
+	if *enableEvccAPI {
+		registerEvccHandlers(config, pipe.flows)
+	}
+
+	quit := make(chan struct{})
+	var quitOnce sync.Once
+	requestQuit := func() {
+		quitOnce.Do(func() {
+			close(quit)
+		})
+	}
+
+	if *enableLifecycle {
+		registerLifecycleHandlers(config, requestQuit, audit)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		audit.record(auditEntry{Action: "quit", Client: "signal " + sig.String(), Outcome: "success"})
+		requestQuit()
+	}()
+
+	logInfo("Listening on %s", *addr)
+
+	p := &poller{
+		config:       config,
+		paused:       pipe.paused,
+		reporter:     reporter,
+		heartbeatURL: *heartbeatURL,
+		observers:    pipe.observers,
+	}
+	registerHealthHandlers(p)
+	p.start()
+	pipe.outputs.start(reporter)
+	if tsdb != nil {
+		go tsdb.record(reg, reporter)
+	}
+
+	srv := &http.Server{Addr: *addr}
+	done := make(chan struct{})
+	go func() {
+		<-quit
+		logInfo("Shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logError("Failed to shut down HTTP server: %v", err)
+		}
+		close(done)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logError("Failed to listen on %s: %v", *addr, err)
 		os.Exit(1)
 	}
+	<-done
 
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	pipe.outputs.stop()
+
+	if len(*stateFile) > 0 {
+		if err := saveState(*stateFile, persisted); err != nil {
+			logError("Failed to save state: %v", err)
+		}
+	}
+
+	if tsdb != nil {
+		if err := tsdb.close(); err != nil {
+			logError("Failed to close local storage: %v", err)
+		}
+	}
 }
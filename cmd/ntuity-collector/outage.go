@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// outageSamples is the number of samples in a row which have to indicate the
+// start or the end of a grid outage, so that a single odd sample isn't taken
+// for one.
+const outageSamples = 3
+
+// siteOutage holds the state of the outage detection of a site.
+type siteOutage struct {
+	active bool
+	// changing counts the samples in a row contradicting active.
+	changing int
+	lastTime time.Time
+}
+
+// outageDetector detects conditions indicating a loss of the grid connection
+// of a site.
+type outageDetector struct {
+	mu      sync.Mutex
+	sites   map[string]*siteOutage
+	outages *prometheus.CounterVec
+	gauge   *prometheus.GaugeVec
+}
+
+func newOutageDetector(reg *prometheus.Registry, config *configStore) *outageDetector {
+	d := &outageDetector{
+		sites: make(map[string]*siteOutage),
+		outages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ntuity",
+				Name:      "grid_outages_total",
+				Help:      "Number of detected grid outages",
+			},
+			[]string{"site"},
+		),
+		gauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "grid_outage_active",
+				Help:      "Whether a grid outage is currently detected (1) or not (0)",
+			},
+			[]string{"site"},
+		),
+	}
+
+	reg.MustRegister(d.outages, d.gauge)
+
+	config.onRemoveSite(func(site string) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.sites, site)
+		d.outages.DeleteLabelValues(site)
+		d.gauge.DeleteLabelValues(site)
+	})
+
+	return d
+}
+
+// gridOutage reports whether the energy flow indicates a grid outage: a grid
+// meter of the site is offline, or the site consumes power while no grid power
+// is reported. A grid power of exactly zero is a valid reading of a site
+// consuming just what it produces and isn't taken for an outage.
+func gridOutage(flow *EnergyFlow) bool {
+	if flow.GridsOnlineCount < flow.GirdsTotalCount {
+		return true
+	}
+	if flow.GirdsTotalCount == 0 || flow.PowerGrid.Value != nil {
+		return false
+	}
+
+	consumption := flow.PowerConsumption.Value
+	if consumption == nil {
+		consumption = flow.PowerConsumptionCalc.Value
+	}
+	return consumption != nil && *consumption > 0
+}
+
+func (d *outageDetector) observe(site string, flow *EnergyFlow) {
+	t := flow.timestamp()
+	outage := gridOutage(flow)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Make sure the counter is exported before the first outage.
+	d.outages.WithLabelValues(site).Add(0)
+
+	s, ok := d.sites[site]
+	if !ok {
+		s = &siteOutage{}
+		d.sites[site] = s
+	}
+
+	// The API keeps returning the last sample while a site doesn't report
+	// new values, which must not count as further samples.
+	if !t.IsZero() && t.After(s.lastTime) {
+		s.lastTime = t
+
+		if outage == s.active {
+			s.changing = 0
+		} else {
+			s.changing++
+			if s.changing >= outageSamples {
+				if outage {
+					logWarning("Grid outage detected for site %s", site)
+					d.outages.WithLabelValues(site).Inc()
+				} else {
+					logInfo("Grid outage ended for site %s", site)
+				}
+				s.active = outage
+				s.changing = 0
+			}
+		}
+	}
+
+	if s.active {
+		d.gauge.WithLabelValues(site).Set(1)
+	} else {
+		d.gauge.WithLabelValues(site).Set(0)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGridOutage(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+
+	for _, c := range []struct {
+		name        string
+		total       int
+		online      int
+		grid        *float64
+		consumption *float64
+		want        bool
+	}{
+		{"grid power reported", 1, 1, value(-250), value(800), false},
+		{"balanced grid power", 1, 1, value(0), value(800), false},
+		{"no grid power while consuming", 1, 1, nil, value(800), true},
+		{"no grid power without consumption", 1, 1, nil, value(0), false},
+		{"no grid power without consumption value", 1, 1, nil, nil, false},
+		{"grid meter offline", 1, 0, value(0), value(800), true},
+		{"one of two grid meters offline", 2, 1, value(300), value(800), true},
+		{"no grid connection", 0, 0, nil, value(800), false},
+	} {
+		flow := &EnergyFlow{
+			PowerGrid:        MetricValue{Value: c.grid},
+			PowerConsumption: MetricValue{Value: c.consumption},
+			GirdsTotalCount:  c.total,
+			GridsOnlineCount: c.online,
+		}
+		if got := gridOutage(flow); got != c.want {
+			t.Errorf("%s: gridOutage = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestOutageDetectorDebounce(t *testing.T) {
+	start := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	consumption := 800.0
+	grid := 0.0
+
+	// outageStep gives the minute of a sample, whether the grid power is
+	// missing and the expected state afterwards.
+	type outageStep struct {
+		minute  int
+		outage  bool
+		active  bool
+		outages float64
+	}
+
+	for _, c := range []struct {
+		name  string
+		steps []outageStep
+	}{
+		{"three samples start an outage", []outageStep{
+			{0, true, false, 0},
+			{1, true, false, 0},
+			{2, true, true, 1},
+			{3, true, true, 1},
+		}},
+		{"repeated samples don't count", []outageStep{
+			{0, true, false, 0},
+			{0, true, false, 0},
+			{0, true, false, 0},
+			{1, true, false, 0},
+			{1, true, false, 0},
+			{2, true, true, 1},
+		}},
+		{"a single odd sample is ignored", []outageStep{
+			{0, true, false, 0},
+			{1, true, false, 0},
+			{2, false, false, 0},
+			{3, true, false, 0},
+			{4, true, false, 0},
+			{5, true, true, 1},
+		}},
+		{"three samples end an outage", []outageStep{
+			{0, true, false, 0},
+			{1, true, false, 0},
+			{2, true, true, 1},
+			{3, false, true, 1},
+			{3, false, true, 1},
+			{4, false, true, 1},
+			{5, false, false, 1},
+			{6, true, false, 1},
+		}},
+	} {
+		d := newOutageDetector(prometheus.NewRegistry(), newConfigStore(&Config{APIKey: "key"}))
+
+		for i, step := range c.steps {
+			flow := &EnergyFlow{
+				PowerConsumption: MetricValue{Value: &consumption, Time: start.Add(time.Duration(step.minute) * time.Minute)},
+				PowerGrid:        MetricValue{Value: &grid},
+				GirdsTotalCount:  1,
+				GridsOnlineCount: 1,
+			}
+			if step.outage {
+				flow.PowerGrid.Value = nil
+			}
+			d.observe("a", flow)
+
+			if got := d.sites["a"].active; got != step.active {
+				t.Errorf("%s: step %d: active = %v, want %v", c.name, i, got, step.active)
+			}
+			if got := testutil.ToFloat64(d.outages.WithLabelValues("a")); got != step.outages {
+				t.Errorf("%s: step %d: outages = %v, want %v", c.name, i, got, step.outages)
+			}
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// outputStaleness is the time after which outputs are switched off if no new
+// energy flow was retrieved for their site.
+const outputStaleness = 5 * time.Minute
+
+// Duration is a time.Duration given as a string like "10m" in the
+// configuration file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return fmt.Errorf("negative duration %s", s)
+	}
+
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// OutputConfig describes an output switched on PV surplus, e.g. an SG-Ready
+// contact of a heat pump or a smart plug.
+type OutputConfig struct {
+	Name string `json:"name"`
+	// Site is the ID of the site whose surplus switches the output.
+	Site string     `json:"site"`
+	Rule OutputRule `json:"rule"`
+
+	GPIO    *GPIOConfig    `json:"gpio,omitempty"`
+	Shelly  *ShellyConfig  `json:"shelly,omitempty"`
+	Tasmota *TasmotaConfig `json:"tasmota,omitempty"`
+}
+
+// OutputRule switches an output on once the surplus reaches OnSurplus and
+// off once it drops below OffSurplus. The surplus is the power exported to
+// the grid plus the power charged into the storages, so it's negative while
+// importing from the grid or discharging the storages.
+type OutputRule struct {
+	OnSurplus  float64 `json:"on_surplus_w"`
+	OffSurplus float64 `json:"off_surplus_w"`
+	// MinSoC is the state of charge (in percent) the storages need to have
+	// for the output to be on.
+	MinSoC float64  `json:"min_soc,omitempty"`
+	MinOn  Duration `json:"min_on,omitempty"`
+	MinOff Duration `json:"min_off,omitempty"`
+}
+
+func (c *Config) validateOutputs() error {
+	seen := make(map[string]bool)
+	for _, o := range c.Outputs {
+		if len(o.Name) == 0 {
+			return fmt.Errorf("output without name given")
+		}
+		if seen[o.Name] {
+			return fmt.Errorf("output %s given more than once", o.Name)
+		}
+		seen[o.Name] = true
+
+		if o.Rule.OffSurplus > o.Rule.OnSurplus {
+			return fmt.Errorf("off surplus of output %s above its on surplus", o.Name)
+		}
+		if _, err := o.driver(); err != nil {
+			return fmt.Errorf("invalid output %s: %v", o.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateOutputSites checks that the outputs refer to known sites. It's
+// checked on the configuration extended by the sites discovered from
+// Kubernetes, which outputs may refer to as well.
+func (c *Config) validateOutputSites() error {
+	for _, o := range c.Outputs {
+		if !c.hasSite(o.Site) {
+			return fmt.Errorf("unknown site %q given for output %s", o.Site, o.Name)
+		}
+	}
+	return nil
+}
+
+// outputDriver switches an output.
+type outputDriver interface {
+	set(on bool) error
+}
+
+func (o OutputConfig) driver() (outputDriver, error) {
+	var drivers []outputDriver
+	if o.GPIO != nil {
+		drivers = append(drivers, o.GPIO)
+	}
+	if o.Shelly != nil {
+		if err := o.Shelly.validate(); err != nil {
+			return nil, err
+		}
+		drivers = append(drivers, o.Shelly)
+	}
+	if o.Tasmota != nil {
+		if err := o.Tasmota.validate(); err != nil {
+			return nil, err
+		}
+		drivers = append(drivers, o.Tasmota)
+	}
+
+	if len(drivers) != 1 {
+		return nil, fmt.Errorf("exactly one driver has to be given")
+	}
+	return drivers[0], nil
+}
+
+// surplus returns the power available for outputs in W.
+func surplus(flow *EnergyFlow) float64 {
+	return -flow.PowerGrid.float() - flow.PowerStorage.float()
+}
+
+// wants returns whether the output should be on according to the rule,
+// leaving the minimum on and off times aside.
+func (r OutputRule) wants(on bool, flow *EnergyFlow) bool {
+	if r.MinSoC > 0 && (flow.StateOfCharge.Value == nil || *flow.StateOfCharge.Value < r.MinSoC) {
+		return false
+	}
+
+	s := surplus(flow)
+	if on {
+		return s >= r.OffSurplus
+	}
+	return s >= r.OnSurplus
+}
+
+// outputState is the state of an output.
+type outputState struct {
+	config   OutputConfig
+	on       bool
+	since    time.Time
+	applied  bool
+	lastSeen time.Time
+	// switches counts the switches of the output, so that the results of
+	// switches overtaken by later ones are ignored.
+	switches int
+}
+
+// pendingSwitch is a state of an output which is yet to be applied to its
+// driver.
+type pendingSwitch struct {
+	state    *outputState
+	config   OutputConfig
+	on       bool
+	switches int
+}
+
+// outputController switches the configured outputs based on the energy flow
+// of their sites. The drivers are set outside of mu, as switching relays
+// over the network may take a while; driverMu keeps the switches in order.
+type outputController struct {
+	mu       sync.Mutex
+	driverMu sync.Mutex
+	outputs  map[string]*outputState
+	stopped  bool
+	config   *configStore
+	state    *prometheus.GaugeVec
+	switches *prometheus.CounterVec
+}
+
+func newOutputController(reg *prometheus.Registry, config *configStore) *outputController {
+	c := &outputController{
+		outputs: make(map[string]*outputState),
+		config:  config,
+		state: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "output_on",
+				Help:      "Whether the output is switched on (1) or off (0)",
+			},
+			[]string{"output", "site"},
+		),
+		switches: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ntuity",
+				Name:      "output_switches_total",
+				Help:      "Number of times the output was switched",
+			},
+			[]string{"output", "site"},
+		),
+	}
+
+	reg.MustRegister(c.state, c.switches)
+
+	return c
+}
+
+// output returns the state of the configured output, which is off initially.
+func (c *outputController) output(o OutputConfig) *outputState {
+	s, ok := c.outputs[o.Name]
+	if !ok {
+		s = &outputState{config: o, lastSeen: time.Now()}
+		c.outputs[o.Name] = s
+		c.switches.WithLabelValues(o.Name, o.Site).Add(0)
+	} else if s.config.Site != o.Site {
+		c.state.DeletePartialMatch(prometheus.Labels{"output": o.Name})
+		c.switches.DeletePartialMatch(prometheus.Labels{"output": o.Name})
+		c.switches.WithLabelValues(o.Name, o.Site).Add(0)
+	}
+	s.config = o
+	return s
+}
+
+// switchOutput switches the output. The new state has to be applied with
+// apply.
+func (c *outputController) switchOutput(s *outputState, on bool, reason string) {
+	logInfo("Switching output %s %s: %s", s.config.Name, onOff(on), reason)
+	s.on = on
+	s.since = time.Now()
+	s.applied = false
+	s.switches++
+	c.switches.WithLabelValues(s.config.Name, s.config.Site).Inc()
+}
+
+// pending returns the switch to apply to the driver of the output, if its
+// state wasn't applied yet.
+func (c *outputController) pending(s *outputState, switches []pendingSwitch) []pendingSwitch {
+	if s.applied {
+		return switches
+	}
+	return append(switches, pendingSwitch{state: s, config: s.config, on: s.on, switches: s.switches})
+}
+
+// apply sets the drivers of the outputs to the given states. It must not be
+// called with mu held. Failures are retried with the next energy flow or
+// check.
+func (c *outputController) apply(switches []pendingSwitch) {
+	c.driverMu.Lock()
+	defer c.driverMu.Unlock()
+
+	for _, p := range switches {
+		c.mu.Lock()
+		current := p.state.switches == p.switches && !p.state.applied
+		c.mu.Unlock()
+		if !current {
+			continue
+		}
+
+		driver, err := p.config.driver()
+		if err == nil {
+			err = driver.set(p.on)
+		}
+		if err != nil {
+			logError("Failed to switch output %s %s: %v", p.config.Name, onOff(p.on), err)
+			continue
+		}
+
+		c.mu.Lock()
+		if p.state.switches == p.switches {
+			p.state.applied = true
+			// Outputs removed from the configuration meanwhile aren't
+			// exported anymore.
+			if c.outputs[p.config.Name] == p.state {
+				if p.on {
+					c.state.WithLabelValues(p.config.Name, p.config.Site).Set(1)
+				} else {
+					c.state.WithLabelValues(p.config.Name, p.config.Site).Set(0)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func (c *outputController) observe(site string, flow *EnergyFlow) {
+	c.apply(c.decide(site, flow))
+}
+
+// decide switches the outputs of the site according to the energy flow and
+// returns the switches to apply.
+func (c *outputController) decide(site string, flow *EnergyFlow) []pendingSwitch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return nil
+	}
+
+	var switches []pendingSwitch
+	now := time.Now()
+	for _, o := range c.config.get().Outputs {
+		if o.Site != site {
+			continue
+		}
+
+		s := c.output(o)
+		s.lastSeen = now
+
+		want := o.Rule.wants(s.on, flow)
+		if want == s.on {
+			switches = c.pending(s, switches)
+			continue
+		}
+
+		minTime := o.Rule.MinOff.Duration
+		if s.on {
+			minTime = o.Rule.MinOn.Duration
+		}
+		if now.Sub(s.since) < minTime {
+			switches = c.pending(s, switches)
+			continue
+		}
+
+		c.switchOutput(s, want, fmt.Sprintf("surplus of %.0f W", surplus(flow)))
+		switches = c.pending(s, switches)
+	}
+	return switches
+}
+
+// check switches off outputs of sites without recent energy flows and
+// outputs removed from the configuration, and retries failed switches.
+func (c *outputController) check() {
+	c.apply(c.checkOutputs())
+}
+
+func (c *outputController) checkOutputs() []pendingSwitch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return nil
+	}
+
+	var switches []pendingSwitch
+	configured := make(map[string]bool)
+	for _, o := range c.config.get().Outputs {
+		configured[o.Name] = true
+
+		s := c.output(o)
+		if s.on && time.Since(s.lastSeen) > outputStaleness {
+			c.switchOutput(s, false, "no recent energy flow")
+		}
+		switches = c.pending(s, switches)
+	}
+
+	for name, s := range c.outputs {
+		if configured[name] {
+			continue
+		}
+		if s.on || !s.applied {
+			c.switchOutput(s, false, "removed from the configuration")
+			switches = c.pending(s, switches)
+		}
+		delete(c.outputs, name)
+		c.state.DeletePartialMatch(prometheus.Labels{"output": name})
+		c.switches.DeletePartialMatch(prometheus.Labels{"output": name})
+	}
+	return switches
+}
+
+func (c *outputController) start(reporter *errorReporter) {
+	go func() {
+		defer reporter.recoverPanic("")
+		for {
+			c.check()
+			time.Sleep(pollInterval)
+		}
+	}()
+}
+
+// stop switches off all outputs which may have been switched on, so that
+// they don't stay on while the collector isn't running, and keeps them off.
+func (c *outputController) stop() {
+	c.mu.Lock()
+	c.stopped = true
+	var switches []pendingSwitch
+	for _, s := range c.outputs {
+		if s.on {
+			c.switchOutput(s, false, "collector shutting down")
+		}
+		switches = c.pending(s, switches)
+	}
+	c.mu.Unlock()
+
+	c.apply(switches)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pausedSites keeps track of the sites for which polling is suspended, e.g.
+// while a site is being commissioned or its API key is migrated.
+type pausedSites struct {
+	mu     sync.Mutex
+	sites  map[string]bool
+	gauge  *prometheus.GaugeVec
+	config *configStore
+}
+
+func newPausedSites(reg *prometheus.Registry, config *configStore) *pausedSites {
+	p := &pausedSites{
+		sites:  make(map[string]bool),
+		config: config,
+		gauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "site_paused",
+				Help:      "Whether polling of the site is paused (1) or not (0)",
+			},
+			[]string{"site"},
+		),
+	}
+
+	reg.MustRegister(p.gauge)
+
+	for _, site := range config.get().Sites {
+		p.gauge.WithLabelValues(site.ID).Set(0)
+	}
+
+	config.onAddSite(func(site string) {
+		p.setPaused(site, false)
+	})
+	config.onRemoveSite(p.remove)
+
+	return p
+}
+
+func (p *pausedSites) isPaused(site string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sites[site]
+}
+
+func (p *pausedSites) setPaused(site string, paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if paused {
+		p.sites[site] = true
+		p.gauge.WithLabelValues(site).Set(1)
+	} else {
+		delete(p.sites, site)
+		p.gauge.WithLabelValues(site).Set(0)
+	}
+}
+
+func (p *pausedSites) remove(site string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.sites, site)
+	p.gauge.DeleteLabelValues(site)
+}
+
+func (p *pausedSites) saveState(s *state) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for site := range p.sites {
+		s.Paused = append(s.Paused, site)
+	}
+}
+
+func (p *pausedSites) restoreState(s *state) {
+	cfg := p.config.get()
+	for _, site := range s.Paused {
+		if cfg.hasSite(site) {
+			p.setPaused(site, true)
+		}
+	}
+}
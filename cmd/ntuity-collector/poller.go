@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pollInterval is the interval in which all sites are polled.
+const pollInterval = time.Second * 60
+
+// flowObserver is notified about every energy flow retrieved for a site.
+type flowObserver interface {
+	observe(site string, flow *EnergyFlow)
+}
+
+// poller polls the energy flow of all sites which aren't paused and passes
+// it on to the observers.
+type poller struct {
+	config       *configStore
+	paused       *pausedSites
+	reporter     *errorReporter
+	heartbeatURL string
+	observers    []flowObserver
+	// client sends the requests to the API, http.DefaultClient if nil.
+	client *http.Client
+	// interval replaces pollInterval if positive.
+	interval time.Duration
+
+	mu        sync.Mutex
+	lastCycle time.Time
+
+	quit, stopped chan struct{}
+}
+
+func (p *poller) pollSite(cfg *Config, site SiteConfig) bool {
+	defer p.reporter.recoverPanic(site.ID)
+
+	client := p.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	flow, err := retrieveEnergyFlow(client, fmt.Sprintf(baseURL, site.ID), cfg.apiKey(site))
+	if err != nil {
+		logError("Failed to collect metrics for site %s: %v", site.ID, err)
+		p.reporter.pollFailed(site.ID, err)
+		return false
+	}
+	p.reporter.pollSucceeded(site.ID)
+
+	for _, o := range p.observers {
+		o.observe(site.ID, flow)
+	}
+
+	return true
+}
+
+// pollCycle polls all sites once and reports whether all of them were polled
+// successfully.
+func (p *poller) pollCycle() bool {
+	cfg := p.config.get()
+	succeeded := true
+	for _, site := range cfg.Sites {
+		if p.paused.isPaused(site.ID) {
+			continue
+		}
+
+		if !p.pollSite(cfg, site) {
+			succeeded = false
+		}
+	}
+
+	p.mu.Lock()
+	p.lastCycle = time.Now()
+	p.mu.Unlock()
+
+	return succeeded
+}
+
+func (p *poller) start() {
+	interval := pollInterval
+	if p.interval > 0 {
+		interval = p.interval
+	}
+
+	p.quit = make(chan struct{})
+	p.stopped = make(chan struct{})
+	go func() {
+		defer close(p.stopped)
+		defer p.reporter.recoverPanic("")
+		for {
+			if p.pollCycle() && len(p.heartbeatURL) > 0 {
+				sendHeartbeat(p.heartbeatURL)
+			}
+
+			select {
+			case <-p.quit:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// stop waits for the current poll cycle to complete and stops polling.
+func (p *poller) stop() {
+	close(p.quit)
+	<-p.stopped
+}
+
+// ready reports whether a poll cycle was completed recently, i.e. the poller
+// is neither still starting up nor stuck.
+func (p *poller) ready() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.lastCycle.IsZero() && time.Since(p.lastCycle) < 5*pollInterval
+}
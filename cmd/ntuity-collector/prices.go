@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// priceRefreshInterval is the interval in which the energy prices of a site
+// are retrieved from the API.
+const priceRefreshInterval = 15 * time.Minute
+
+// priceMaxAge is the age up to which the last retrieved official prices are
+// used while retrieving them fails.
+const priceMaxAge = time.Hour
+
+// PriceConfig holds manually configured energy prices per kWh, used for sites
+// without official prices from the API.
+type PriceConfig struct {
+	Import float64 `json:"import"`
+	Export float64 `json:"export"`
+}
+
+// EnergyPrices is the response of the energy prices endpoint of the API.
+type EnergyPrices struct {
+	ImportPrice MetricValue `json:"import_price"`
+	ExportPrice MetricValue `json:"export_price"`
+}
+
+func retrieveEnergyPrices(siteURL, apiKey string) (*EnergyPrices, error) {
+	var prices EnergyPrices
+	if err := retrieve("energy_prices", siteURL, apiKey, &prices); err != nil {
+		return nil, err
+	}
+
+	return &prices, nil
+}
+
+// sitePrices holds the energy prices and costs of a site.
+type sitePrices struct {
+	powerIntegrator
+	Costs map[string]float64 `json:"costs"`
+
+	official    *EnergyPrices
+	updated     time.Time
+	lastRefresh time.Time
+}
+
+// priceTracker retrieves the official energy prices of each site, falling
+// back to manually configured ones, and calculates the costs of the energy
+// imported from and the revenue of the energy exported to the grid.
+type priceTracker struct {
+	mu     sync.Mutex
+	sites  map[string]*sitePrices
+	config *configStore
+
+	price    *prometheus.GaugeVec
+	official *prometheus.GaugeVec
+	costDesc *prometheus.Desc
+}
+
+func newPriceTracker(reg *prometheus.Registry, config *configStore) *priceTracker {
+	p := &priceTracker{
+		sites:  make(map[string]*sitePrices),
+		config: config,
+		price: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "energy_price_per_kwh",
+				Help:      "Current price per kWh imported from (import) or paid for exporting to (export) the grid",
+			},
+			[]string{"site", "direction"},
+		),
+		official: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "energy_price_official",
+				Help:      "Whether the current prices were retrieved from the API (1) or configured manually (0)",
+			},
+			[]string{"site"},
+		),
+		costDesc: prometheus.NewDesc(
+			"ntuity_energy_cost_total",
+			"Costs of the energy imported from (import) or revenue of the energy exported to (export) the grid",
+			[]string{"site", "direction"}, nil,
+		),
+	}
+
+	reg.MustRegister(p, p.price, p.official)
+
+	config.onRemoveSite(func(site string) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.sites, site)
+		p.price.DeletePartialMatch(prometheus.Labels{"site": site})
+		p.official.DeleteLabelValues(site)
+	})
+
+	return p
+}
+
+// retrieveOfficialPrices retrieves the official prices of the site. Sites for
+// which the endpoint isn't available keep using the configured prices.
+func (p *priceTracker) retrieveOfficialPrices(site SiteConfig) (*EnergyPrices, error) {
+	prices, err := retrieveEnergyPrices(fmt.Sprintf(pricesURL, site.ID), p.config.get().apiKey(site))
+	if err != nil {
+		if isNotAvailable(err) {
+			return nil, nil
+		}
+		logError("Failed to retrieve energy prices for site %s: %v", site.ID, err)
+		return nil, err
+	}
+
+	return prices, nil
+}
+
+// currentPrices returns the prices per kWh for importing and exporting
+// energy, preferring official prices over configured ones.
+func currentPrices(site SiteConfig, s *sitePrices) (map[string]float64, bool, bool) {
+	if s.official != nil && s.official.ImportPrice.Value != nil && s.official.ExportPrice.Value != nil {
+		return map[string]float64{
+			"import": *s.official.ImportPrice.Value,
+			"export": *s.official.ExportPrice.Value,
+		}, true, true
+	}
+
+	if site.Prices != nil {
+		return map[string]float64{
+			"import": site.Prices.Import,
+			"export": site.Prices.Export,
+		}, false, true
+	}
+
+	return nil, false, false
+}
+
+func (p *priceTracker) observe(site string, flow *EnergyFlow) {
+	siteConfig, ok := p.config.get().site(site)
+	if !ok {
+		return
+	}
+
+	grid := flow.PowerGrid.float()
+	power := map[string]float64{
+		"import": positive(grid),
+		"export": positive(-grid),
+	}
+
+	p.mu.Lock()
+	s, ok := p.sites[site]
+	if !ok {
+		s = &sitePrices{Costs: make(map[string]float64)}
+		p.sites[site] = s
+	}
+	refresh := time.Since(s.lastRefresh) >= priceRefreshInterval
+	p.mu.Unlock()
+
+	// Don't block scrapes while waiting for the API.
+	var official *EnergyPrices
+	var err error
+	if refresh {
+		official, err = p.retrieveOfficialPrices(siteConfig)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if refresh {
+		s.lastRefresh = time.Now()
+		if err == nil {
+			s.official = official
+			s.updated = s.lastRefresh
+		} else if time.Since(s.updated) > priceMaxAge {
+			s.official = nil
+		}
+	}
+
+	prices, isOfficial, ok := currentPrices(siteConfig, s)
+	if !ok {
+		s.step(flow.PowerGrid.Time, power)
+		return
+	}
+
+	for direction, price := range prices {
+		p.price.WithLabelValues(site, direction).Set(price)
+	}
+	if isOfficial {
+		p.official.WithLabelValues(site).Set(1)
+	} else {
+		p.official.WithLabelValues(site).Set(0)
+	}
+
+	energy, _ := s.step(flow.PowerGrid.Time, power)
+	for direction, wh := range energy {
+		s.Costs[direction] += wh / 1000 * prices[direction]
+	}
+}
+
+func (p *priceTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.costDesc
+}
+
+func (p *priceTracker) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for site, s := range p.sites {
+		for direction, cost := range s.Costs {
+			ch <- prometheus.MustNewConstMetric(p.costDesc, prometheus.CounterValue, cost, site, direction)
+		}
+	}
+}
+
+func (p *priceTracker) saveState(s *state) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.Prices = make(map[string]*sitePrices)
+	for site, prices := range p.sites {
+		copied := &sitePrices{
+			powerIntegrator: prices.powerIntegrator,
+			Costs:           copyValues(prices.Costs),
+		}
+		copied.LastPower = copyValues(prices.LastPower)
+		s.Prices[site] = copied
+	}
+}
+
+func (p *priceTracker) restoreState(s *state) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cfg := p.config.get()
+	for site, prices := range s.Prices {
+		if !cfg.hasSite(site) {
+			continue
+		}
+		if prices.Costs == nil {
+			prices.Costs = make(map[string]float64)
+		}
+		p.sites[site] = prices
+	}
+}
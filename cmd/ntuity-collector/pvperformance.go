@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// standardIrradiance is the irradiance in W/m² under standard test
+// conditions, which the peak power of PV modules refers to.
+const standardIrradiance = 1000
+
+// pvPerformance derives the specific yield and the performance ratio of the
+// PV installations of sites with a configured peak power from the energy
+// counters and the weather.
+type pvPerformance struct {
+	config  *configStore
+	energy  *energyCounters
+	weather *weatherTracker
+
+	specificYieldDesc    *prometheus.Desc
+	performanceRatioDesc *prometheus.Desc
+}
+
+func newPVPerformance(reg *prometheus.Registry, config *configStore, energy *energyCounters, weather *weatherTracker) *pvPerformance {
+	p := &pvPerformance{
+		config:  config,
+		energy:  energy,
+		weather: weather,
+		specificYieldDesc: prometheus.NewDesc(
+			"ntuity_pv_specific_yield_today_kwh_per_kwp",
+			"Energy produced since midnight per installed peak power",
+			[]string{"site"}, nil,
+		),
+		performanceRatioDesc: prometheus.NewDesc(
+			"ntuity_pv_performance_ratio_today",
+			"Estimated performance ratio since midnight, i.e. the specific yield per global horizontal irradiation at standard test conditions",
+			[]string{"site"}, nil,
+		),
+	}
+
+	reg.MustRegister(p)
+
+	return p
+}
+
+func (p *pvPerformance) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.specificYieldDesc
+	ch <- p.performanceRatioDesc
+}
+
+func (p *pvPerformance) Collect(ch chan<- prometheus.Metric) {
+	for _, site := range p.config.get().Sites {
+		if site.PeakPower <= 0 {
+			continue
+		}
+
+		production, ok := p.energy.today(site.ID, "production")
+		if !ok {
+			continue
+		}
+
+		specificYield := production / 1000 / site.PeakPower
+		ch <- prometheus.MustNewConstMetric(p.specificYieldDesc, prometheus.GaugeValue, specificYield, site.ID)
+
+		irradiation, ok := p.weather.irradiationToday(site.ID)
+		if !ok || irradiation <= 0 {
+			continue
+		}
+
+		ratio := specificYield / (irradiation / standardIrradiance)
+		ch <- prometheus.MustNewConstMetric(p.performanceRatioDesc, prometheus.GaugeValue, ratio, site.ID)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// flowValue is a single value of an energy flow.
+type flowValue struct {
+	Name  string    `json:"name"`
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+// flowValues returns the values reported in the energy flow, named like the
+// fields of the API response, sorted by name.
+func flowValues(flow *EnergyFlow) ([]flowValue, error) {
+	bs, err := json.Marshal(flow)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(bs, &fields); err != nil {
+		return nil, err
+	}
+
+	var values []flowValue
+	for name, raw := range fields {
+		// Only the measured values are objects, the device counts are plain
+		// numbers.
+		var v MetricValue
+		if err := json.Unmarshal(raw, &v); err != nil || v.Value == nil {
+			continue
+		}
+		values = append(values, flowValue{Name: name, Value: *v.Value, Time: v.Time})
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Name < values[j].Name
+	})
+
+	return values, nil
+}
+
+func printValuesTable(w io.Writer, values []flowValue) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "NAME\tVALUE\tTIME\n")
+	for _, v := range values {
+		fmt.Fprintf(tw, "%s\t%g\t%s\n", v.Name, v.Value, v.Time.Local().Format(time.RFC3339))
+	}
+	tw.Flush()
+}
+
+// printValuesProm prints the values in the Prometheus text format, named like
+// the metrics of the collector.
+func printValuesProm(w io.Writer, site string, values []flowValue) error {
+	for _, v := range values {
+		family := &dto.MetricFamily{
+			Name: proto.String("ntuity_" + v.Name),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label:       []*dto.LabelPair{{Name: proto.String("site"), Value: proto.String(site)}},
+				Gauge:       &dto.Gauge{Value: proto.Float64(v.Value)},
+				TimestampMs: proto.Int64(v.Time.UnixNano() / int64(time.Millisecond)),
+			}},
+		}
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runQuery retrieves the energy flow of a site once and prints its values.
+func runQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	site := fs.String("site", "", "ID of the site to query")
+	metric := fs.String("metric", "", "Only print the given value, e.g. power_grid")
+	format := fs.String("format", "table", "Output format (table, json or prom)")
+	fs.Parse(args)
+
+	if len(*site) == 0 {
+		fmt.Fprintf(os.Stderr, "No site ID given\n")
+		return 1
+	}
+	if *format != "table" && *format != "json" && *format != "prom" {
+		fmt.Fprintf(os.Stderr, "Unknown format %q\n", *format)
+		return 1
+	}
+
+	apiKey := os.Getenv("NTUITY_API_KEY")
+	if len(apiKey) == 0 {
+		fmt.Fprintf(os.Stderr, "No api key given\n")
+		return 1
+	}
+
+	flow, err := retrieveEnergyFlow(http.DefaultClient, fmt.Sprintf(baseURL, *site), apiKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to retrieve energy flow: %v\n", err)
+		return 1
+	}
+
+	values, err := flowValues(flow)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to retrieve energy flow: %v\n", err)
+		return 1
+	}
+
+	if len(*metric) > 0 {
+		var filtered []flowValue
+		for _, v := range values {
+			if v.Name == *metric {
+				filtered = append(filtered, v)
+			}
+		}
+		if len(filtered) == 0 {
+			fmt.Fprintf(os.Stderr, "No value %q reported for site %s\n", *metric, *site)
+			return 1
+		}
+		values = filtered
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(values)
+	case "prom":
+		if err := printValuesProm(os.Stdout, *site, values); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print values: %v\n", err)
+			return 1
+		}
+	default:
+		printValuesTable(os.Stdout, values)
+	}
+
+	return 0
+}
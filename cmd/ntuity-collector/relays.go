@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var relayClient = &http.Client{Timeout: 10 * time.Second}
+
+// switchRelay sends a request switching a smart plug or relay through its
+// local HTTP API.
+func switchRelay(req *http.Request) error {
+	res, err := relayClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// ShellyConfig is a Shelly relay or smart plug switched through its local
+// HTTP API. Generation 1 devices use the /relay endpoint with optional basic
+// authentication, generation 2 and later devices the RPC API, which has to
+// have authentication disabled.
+type ShellyConfig struct {
+	Address    string `json:"address"`
+	Generation int    `json:"generation,omitempty"`
+	Channel    int    `json:"channel,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+}
+
+func (s *ShellyConfig) validate() error {
+	if len(s.Address) == 0 {
+		return fmt.Errorf("no address given for Shelly")
+	}
+	if s.Generation < 0 || s.Generation > 3 {
+		return fmt.Errorf("unknown Shelly generation %d", s.Generation)
+	}
+	return nil
+}
+
+func (s *ShellyConfig) set(on bool) error {
+	var u string
+	if s.Generation >= 2 {
+		u = fmt.Sprintf("http://%s/rpc/Switch.Set?id=%d&on=%t", s.Address, s.Channel, on)
+	} else {
+		u = fmt.Sprintf("http://%s/relay/%d?turn=%s", s.Address, s.Channel, onOff(on))
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if len(s.Username) > 0 {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+
+	return switchRelay(req)
+}
+
+// TasmotaConfig is a relay or smart plug running Tasmota, switched through
+// its local HTTP API. Relay is the number of the relay, starting at 1.
+type TasmotaConfig struct {
+	Address  string `json:"address"`
+	Relay    int    `json:"relay,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+func (t *TasmotaConfig) validate() error {
+	if len(t.Address) == 0 {
+		return fmt.Errorf("no address given for Tasmota")
+	}
+	if t.Relay < 0 {
+		return fmt.Errorf("invalid Tasmota relay %d", t.Relay)
+	}
+	return nil
+}
+
+func (t *TasmotaConfig) set(on bool) error {
+	relay := t.Relay
+	if relay == 0 {
+		relay = 1
+	}
+
+	query := url.Values{}
+	query.Set("cmnd", fmt.Sprintf("Power%d %s", relay, onOff(on)))
+	if len(t.Username) > 0 {
+		query.Set("user", t.Username)
+		query.Set("password", t.Password)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/cm?%s", t.Address, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+
+	return switchRelay(req)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Types of label matchers in remote-read queries.
+const (
+	matchEqual = iota
+	matchNotEqual
+	matchRegexp
+	matchNotRegexp
+)
+
+// labelMatcher matches the value of a label. Missing labels have an empty
+// value, as in PromQL.
+type labelMatcher struct {
+	typ   uint64
+	name  string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m *labelMatcher) matches(labels []tsdbLabel) bool {
+	var value string
+	for _, l := range labels {
+		if l.name == m.name {
+			value = l.value
+			break
+		}
+	}
+
+	switch m.typ {
+	case matchEqual:
+		return value == m.value
+	case matchNotEqual:
+		return value != m.value
+	case matchRegexp:
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// remoteQuery is a query of a remote-read request.
+type remoteQuery struct {
+	start, end int64
+	matchers   []*labelMatcher
+	// sites restricts the query to the series of the given sites, e.g. the
+	// ones of a tenant, if not nil.
+	sites map[string]bool
+}
+
+func (q *remoteQuery) matches(labels []tsdbLabel) bool {
+	if q.sites != nil {
+		var site string
+		for _, l := range labels {
+			if l.name == "site" {
+				site = l.value
+				break
+			}
+		}
+		if !q.sites[site] {
+			return false
+		}
+	}
+
+	for _, m := range q.matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxQuerySamples limits the samples returned for a query, which are held in
+// memory until the response is sent.
+const maxQuerySamples = 10000000
+
+var errSampleLimit = fmt.Errorf("query exceeds the limit of %d samples", maxQuerySamples)
+
+// query returns the series matching all matchers with their samples in the
+// time range of the query, read from the segments overlapping it.
+func (s *localStorage) query(q *remoteQuery) ([]*tsdbSeries, error) {
+	segments, err := s.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	start := q.start
+	if cutoff := time.Now().Add(-s.retention).UnixNano() / int64(time.Millisecond); cutoff > start {
+		start = cutoff
+	}
+
+	series := make(map[string]*tsdbSeries)
+	var n int
+	for i, segment := range segments {
+		if segment.start.UnixNano()/int64(time.Millisecond) > q.end {
+			break
+		}
+		if i+1 < len(segments) && segments[i+1].start.UnixNano()/int64(time.Millisecond) <= start {
+			continue
+		}
+
+		// The series of the segment by their ID, nil if not matching.
+		ids := make(map[uint64]*tsdbSeries)
+		err := scanSegment(segment.path, segment.size, func(record []byte) error {
+			d := &decoder{b: record[1:]}
+
+			switch record[0] {
+			case recordSeries:
+				id := d.uvarint()
+				labels := make([]tsdbLabel, d.uvarint())
+				for i := range labels {
+					labels[i] = tsdbLabel{name: d.string(), value: d.string()}
+				}
+				if d.err != nil || !q.matches(labels) {
+					return nil
+				}
+
+				key := seriesKey(labels)
+				if _, ok := series[key]; !ok {
+					series[key] = &tsdbSeries{labels: labels}
+				}
+				ids[id] = series[key]
+
+			case recordSamples:
+				t := d.varint()
+				if t < start || t > q.end {
+					return nil
+				}
+				count := d.uvarint()
+				for i := uint64(0); i < count && d.err == nil; i++ {
+					matched := ids[d.uvarint()]
+					v := d.float()
+					if matched == nil || d.err != nil {
+						continue
+					}
+					matched.samples = append(matched.samples, tsdbSample{t: t, v: v})
+					n++
+				}
+				if n > maxQuerySamples {
+					return errSampleLimit
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, errTornRecord) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	var result []*tsdbSeries
+	for _, series := range series {
+		if len(series.samples) > 0 {
+			result = append(result, series)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return seriesKey(result[i].labels) < seriesKey(result[j].labels)
+	})
+
+	return result, nil
+}
+
+// protoFields calls fn for every field of a protobuf message, passing the
+// value of varint fields and the content of length-delimited ones. Other
+// fields are skipped.
+func protoFields(b []byte, fn func(num protowire.Number, v uint64, bs []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v uint64
+		var bs []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			bs, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, v, bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseReadRequest parses the queries of a remote-read request.
+func parseReadRequest(b []byte) ([]*remoteQuery, error) {
+	var queries []*remoteQuery
+	err := protoFields(b, func(num protowire.Number, _ uint64, bs []byte) error {
+		if num != 1 {
+			return nil
+		}
+		q, err := parseQuery(bs)
+		if err != nil {
+			return err
+		}
+		queries = append(queries, q)
+		return nil
+	})
+	return queries, err
+}
+
+func parseQuery(b []byte) (*remoteQuery, error) {
+	q := &remoteQuery{}
+	err := protoFields(b, func(num protowire.Number, v uint64, bs []byte) error {
+		switch num {
+		case 1:
+			q.start = int64(v)
+		case 2:
+			q.end = int64(v)
+		case 3:
+			m, err := parseMatcher(bs)
+			if err != nil {
+				return err
+			}
+			q.matchers = append(q.matchers, m)
+		}
+		return nil
+	})
+	return q, err
+}
+
+func parseMatcher(b []byte) (*labelMatcher, error) {
+	m := &labelMatcher{}
+	err := protoFields(b, func(num protowire.Number, v uint64, bs []byte) error {
+		switch num {
+		case 1:
+			m.typ = v
+		case 2:
+			m.name = string(bs)
+		case 3:
+			m.value = string(bs)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch m.typ {
+	case matchEqual, matchNotEqual:
+	case matchRegexp, matchNotRegexp:
+		// Regular expressions are fully anchored, as in PromQL.
+		m.re, err = regexp.Compile("^(?:" + m.value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", m.value, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown matcher type %d", m.typ)
+	}
+
+	return m, nil
+}
+
+// appendMessage appends a length-delimited field containing the message
+// encoded by fn.
+func appendMessage(b []byte, num protowire.Number, fn func(b []byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, fn(nil))
+}
+
+// encodeReadResponse encodes the results of the queries as ReadResponse.
+func encodeReadResponse(results [][]*tsdbSeries) []byte {
+	var b []byte
+	for _, result := range results {
+		b = appendMessage(b, 1, func(b []byte) []byte {
+			for _, series := range result {
+				b = appendMessage(b, 1, func(b []byte) []byte {
+					for _, l := range series.labels {
+						b = appendMessage(b, 1, func(b []byte) []byte {
+							b = protowire.AppendTag(b, 1, protowire.BytesType)
+							b = protowire.AppendString(b, l.name)
+							b = protowire.AppendTag(b, 2, protowire.BytesType)
+							return protowire.AppendString(b, l.value)
+						})
+					}
+					for _, sample := range series.samples {
+						b = appendMessage(b, 2, func(b []byte) []byte {
+							b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+							b = protowire.AppendFixed64(b, math.Float64bits(sample.v))
+							b = protowire.AppendTag(b, 2, protowire.VarintType)
+							return protowire.AppendVarint(b, uint64(sample.t))
+						})
+					}
+					return b
+				})
+			}
+			return b
+		})
+	}
+	return b
+}
+
+// maxReadRequestSize limits the size of remote-read requests, compressed and
+// decompressed. Prometheus sends a few KB at most.
+const maxReadRequestSize = 1 << 20
+
+// registerRemoteReadHandler serves the samples of the local storage through
+// the Prometheus remote-read API. Like /metrics, it serves all sites.
+func registerRemoteReadHandler(storage *localStorage) {
+	http.HandleFunc("/api/v1/read", func(w http.ResponseWriter, r *http.Request) {
+		serveRemoteRead(w, r, storage, nil)
+	})
+}
+
+// serveRemoteRead answers a remote-read request with the samples of the given
+// sites, or of all sites if nil. Only the sampled response type is
+// supported, which all Prometheus versions accept.
+func serveRemoteRead(w http.ResponseWriter, r *http.Request, storage *localStorage, sites map[string]bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxReadRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if n, err := snappy.DecodedLen(compressed); err != nil || n > maxReadRequestSize {
+		http.Error(w, "invalid request: too large or corrupt", http.StatusBadRequest)
+		return
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	queries, err := parseReadRequest(b)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	results := make([][]*tsdbSeries, len(queries))
+	for i, q := range queries {
+		q.sites = sites
+		results[i], err = storage.query(q)
+		if err == errSampleLimit {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logError("Failed to query local storage: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(snappy.Encode(nil, encodeReadResponse(results))); err != nil {
+		logError("Failed to send remote-read response: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendMatcher(b []byte, typ uint64, name, value string) []byte {
+	return appendMessage(b, 3, func(b []byte) []byte {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, typ)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, name)
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		return protowire.AppendString(b, value)
+	})
+}
+
+func TestParseReadRequest(t *testing.T) {
+	var req []byte
+	req = appendMessage(req, 1, func(b []byte) []byte {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1000)
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, 2000)
+		b = appendMatcher(b, matchEqual, "__name__", "ntuity_power_grid")
+		b = appendMatcher(b, matchRegexp, "site", "a|b")
+		// Hints and other unknown fields are skipped.
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		return protowire.AppendBytes(b, []byte{0x08, 0x01})
+	})
+	// The accepted response types of newer Prometheus versions.
+	req = protowire.AppendTag(req, 2, protowire.VarintType)
+	req = protowire.AppendVarint(req, 0)
+
+	queries, err := parseReadRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 {
+		t.Fatalf("got %d queries, want 1", len(queries))
+	}
+
+	q := queries[0]
+	if q.start != 1000 || q.end != 2000 || len(q.matchers) != 2 {
+		t.Fatalf("got query %+v", q)
+	}
+
+	for _, c := range []struct {
+		labels []tsdbLabel
+		want   bool
+	}{
+		{[]tsdbLabel{{"__name__", "ntuity_power_grid"}, {"site", "a"}}, true},
+		{[]tsdbLabel{{"__name__", "ntuity_power_grid"}, {"site", "b"}}, true},
+		// Regular expressions are anchored.
+		{[]tsdbLabel{{"__name__", "ntuity_power_grid"}, {"site", "ab"}}, false},
+		{[]tsdbLabel{{"__name__", "ntuity_power_grid"}}, false},
+		{[]tsdbLabel{{"__name__", "ntuity_power_production"}, {"site", "a"}}, false},
+	} {
+		if got := q.matches(c.labels); got != c.want {
+			t.Errorf("matches(%v) = %v, want %v", c.labels, got, c.want)
+		}
+	}
+}
+
+func TestParseReadRequestInvalid(t *testing.T) {
+	for name, req := range map[string][]byte{
+		"unknown matcher type": appendMessage(nil, 1, func(b []byte) []byte {
+			return appendMatcher(b, 7, "site", "a")
+		}),
+		"invalid regexp": appendMessage(nil, 1, func(b []byte) []byte {
+			return appendMatcher(b, matchRegexp, "site", "(")
+		}),
+		"truncated": appendMessage(nil, 1, func(b []byte) []byte {
+			return appendMatcher(b, matchEqual, "site", "a")
+		})[:5],
+	} {
+		if _, err := parseReadRequest(req); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// decodeReadResponse decodes a ReadResponse as encoded by encodeReadResponse.
+func decodeReadResponse(t *testing.T, b []byte) [][]*tsdbSeries {
+	t.Helper()
+
+	var results [][]*tsdbSeries
+	err := protoFields(b, func(num protowire.Number, _ uint64, bs []byte) error {
+		var result []*tsdbSeries
+		err := protoFields(bs, func(num protowire.Number, _ uint64, bs []byte) error {
+			series := &tsdbSeries{}
+			err := protoFields(bs, func(num protowire.Number, _ uint64, bs []byte) error {
+				switch num {
+				case 1:
+					var l tsdbLabel
+					err := protoFields(bs, func(num protowire.Number, _ uint64, bs []byte) error {
+						if num == 1 {
+							l.name = string(bs)
+						} else {
+							l.value = string(bs)
+						}
+						return nil
+					})
+					series.labels = append(series.labels, l)
+					return err
+				case 2:
+					// The value is a fixed64 field, which protoFields skips.
+					var sample tsdbSample
+					for len(bs) > 0 {
+						num, typ, n := protowire.ConsumeTag(bs)
+						bs = bs[n:]
+						if typ == protowire.Fixed64Type {
+							v, n := protowire.ConsumeFixed64(bs)
+							sample.v = math.Float64frombits(v)
+							bs = bs[n:]
+						} else {
+							v, n := protowire.ConsumeVarint(bs)
+							if num == 2 {
+								sample.t = int64(v)
+							}
+							bs = bs[n:]
+						}
+					}
+					series.samples = append(series.samples, sample)
+				}
+				return nil
+			})
+			result = append(result, series)
+			return err
+		})
+		results = append(results, result)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestEncodeReadResponse(t *testing.T) {
+	results := [][]*tsdbSeries{
+		{
+			{
+				labels:  []tsdbLabel{{"__name__", "ntuity_power_grid"}, {"site", "a"}},
+				samples: []tsdbSample{{1000, -250.5}, {61000, 0}},
+			},
+			{
+				labels:  []tsdbLabel{{"__name__", "ntuity_power_grid"}, {"site", "b"}},
+				samples: []tsdbSample{{1000, 1e6}},
+			},
+		},
+		{
+			{
+				labels:  []tsdbLabel{{"__name__", "ntuity_state_of_charge"}, {"site", "a"}},
+				samples: []tsdbSample{{1000, 55}},
+			},
+		},
+	}
+
+	if got := decodeReadResponse(t, encodeReadResponse(results)); !reflect.DeepEqual(got, results) {
+		t.Errorf("got %+v, want %+v", got, results)
+	}
+}
+
+func TestRemoteQuerySites(t *testing.T) {
+	q := &remoteQuery{
+		matchers: []*labelMatcher{{typ: matchEqual, name: "__name__", value: "ntuity_power_grid"}},
+		sites:    map[string]bool{"a": true},
+	}
+
+	for _, c := range []struct {
+		labels []tsdbLabel
+		want   bool
+	}{
+		{[]tsdbLabel{{"__name__", "ntuity_power_grid"}, {"site", "a"}}, true},
+		{[]tsdbLabel{{"__name__", "ntuity_power_grid"}, {"site", "b"}}, false},
+		// Series without a site belong to no tenant.
+		{[]tsdbLabel{{"__name__", "ntuity_power_grid"}}, false},
+	} {
+		if got := q.matches(c.labels); got != c.want {
+			t.Errorf("matches(%v) = %v, want %v", c.labels, got, c.want)
+		}
+	}
+}
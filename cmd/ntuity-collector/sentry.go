@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorReporter reports panics and repeated poll failures to Sentry or a
+// compatible service like GlitchTip. A nil errorReporter doesn't report
+// anything.
+type errorReporter struct {
+	storeURL  string
+	publicKey string
+	threshold int
+	client    *http.Client
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+// newErrorReporter parses a DSN of the form
+// https://<public key>@<host>/<project id>.
+func newErrorReporter(dsn string, threshold int) (*errorReporter, error) {
+	if threshold <= 0 {
+		return nil, fmt.Errorf("failure threshold %d isn't positive", threshold)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DSN: %v", err)
+	}
+	if u.User == nil || len(u.User.Username()) == 0 {
+		return nil, fmt.Errorf("invalid DSN: no public key given")
+	}
+
+	projectID := path.Base(u.Path)
+	if len(projectID) == 0 || projectID == "/" || projectID == "." {
+		return nil, fmt.Errorf("invalid DSN: no project ID given")
+	}
+
+	store := url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   path.Join(path.Dir(u.Path), "api", projectID, "store") + "/",
+	}
+
+	return &errorReporter{
+		storeURL:  store.String(),
+		publicKey: u.User.Username(),
+		threshold: threshold,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		failures:  make(map[string]int),
+	}, nil
+}
+
+type sentryEvent struct {
+	EventID    string                 `json:"event_id"`
+	Timestamp  string                 `json:"timestamp"`
+	Level      string                 `json:"level"`
+	Platform   string                 `json:"platform"`
+	Logger     string                 `json:"logger"`
+	ServerName string                 `json:"server_name,omitempty"`
+	Message    string                 `json:"message"`
+	Tags       map[string]string      `json:"tags,omitempty"`
+	Extra      map[string]interface{} `json:"extra,omitempty"`
+}
+
+func (r *errorReporter) send(level, message string, tags map[string]string, extra map[string]interface{}) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+
+	event := sentryEvent{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Level:      level,
+		Platform:   "go",
+		Logger:     logIdentifier,
+		ServerName: hostname,
+		Message:    message,
+		Tags:       tags,
+		Extra:      extra,
+	}
+
+	bs, err := json.Marshal(&event)
+	if err != nil {
+		logError("Failed to encode error report: %v", err)
+		return
+	}
+
+	req, _ := http.NewRequest("POST", r.storeURL, bytes.NewReader(bs))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s/1.0, sentry_key=%s", logIdentifier, r.publicKey))
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		logError("Failed to send error report: %v", err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		logError("Failed to send error report: unexpected response status %d", res.StatusCode)
+	}
+}
+
+// pollFailed reports a site once its polls failed threshold times in a row.
+func (r *errorReporter) pollFailed(site string, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.failures[site]++
+	failures := r.failures[site]
+	r.mu.Unlock()
+
+	if failures != r.threshold {
+		return
+	}
+
+	go r.send("error",
+		fmt.Sprintf("Polling site %s failed %d times in a row: %v", site, failures, err),
+		map[string]string{"site": site},
+		map[string]interface{}{"error": err.Error(), "failures": failures})
+}
+
+func (r *errorReporter) pollSucceeded(site string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.failures, site)
+}
+
+// recoverPanic reports a panic of the calling goroutine before continuing to
+// panic. It has to be deferred.
+func (r *errorReporter) recoverPanic(site string) {
+	if r == nil {
+		return
+	}
+
+	if p := recover(); p != nil {
+		tags := map[string]string{}
+		if len(site) > 0 {
+			tags["site"] = site
+		}
+
+		stack := string(debug.Stack())
+		r.send("fatal", fmt.Sprintf("panic: %v", p), tags, map[string]interface{}{
+			"stacktrace": strings.Split(stack, "\n"),
+		})
+		panic(p)
+	}
+}
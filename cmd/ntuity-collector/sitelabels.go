@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// siteLabels exports the labels of the sites as ntuity_site_labels to join
+// them to other metrics in queries. As the label names differ between sites,
+// every site is exported with the labels of all sites, prefixed with
+// "label_", and the collector is unchecked.
+type siteLabels struct {
+	sites func() []SiteConfig
+}
+
+// siteLabelsName is the name of the metric exported by siteLabels.
+const siteLabelsName = "ntuity_site_labels"
+
+func newSiteLabels(reg *prometheus.Registry, config *configStore) *siteLabels {
+	l := &siteLabels{sites: func() []SiteConfig {
+		return config.get().Sites
+	}}
+	reg.MustRegister(l)
+	return l
+}
+
+func (l *siteLabels) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (l *siteLabels) Collect(ch chan<- prometheus.Metric) {
+	sites := l.sites()
+
+	// Label keys of different sites may map to the same label name, e.g.
+	// app.kubernetes.io/name and app-kubernetes-io/name. A site takes the
+	// value of the first of its keys in sort order.
+	keys := make(map[string][]string)
+	for _, site := range sites {
+		for key := range site.Labels {
+			name := "label_" + sanitizeLabelName(key)
+			if !containsString(keys[name], key) {
+				keys[name] = append(keys[name], key)
+			}
+		}
+	}
+
+	var names []string
+	for name := range keys {
+		names = append(names, name)
+		sort.Strings(keys[name])
+	}
+	sort.Strings(names)
+
+	desc := prometheus.NewDesc(
+		siteLabelsName,
+		"Labels of the site, always 1",
+		append([]string{"site"}, names...), nil,
+	)
+
+	for _, site := range sites {
+		values := []string{site.ID}
+		for _, name := range names {
+			var value string
+			for _, key := range keys[name] {
+				if v, ok := site.Labels[key]; ok {
+					value = v
+					break
+				}
+			}
+			values = append(values, value)
+		}
+
+		m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+		if err != nil {
+			m = prometheus.NewInvalidMetric(desc, err)
+		}
+		ch <- m
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSiteLabels checks that no two label keys of a site map to the same
+// label name.
+func validateSiteLabels(labels map[string]string) error {
+	keys := make(map[string]string)
+	for key := range labels {
+		name := sanitizeLabelName(key)
+		if other, ok := keys[name]; ok {
+			if other > key {
+				other, key = key, other
+			}
+			return fmt.Errorf("labels %s and %s both map to label_%s", other, key, name)
+		}
+		keys[name] = key
+	}
+	return nil
+}
+
+// sanitizeLabelName replaces all characters not allowed in label names, e.g.
+// of Kubernetes label keys like app.kubernetes.io/name, with underscores.
+func sanitizeLabelName(name string) string {
+	bs := []byte(name)
+	for i, b := range bs {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_') {
+			bs[i] = '_'
+		}
+	}
+	return string(bs)
+}
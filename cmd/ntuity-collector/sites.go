@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// SiteAddress is the postal address of a site.
+type SiteAddress struct {
+	Street     string `json:"street"`
+	PostalCode string `json:"postal_code"`
+	City       string `json:"city"`
+	Country    string `json:"country"`
+}
+
+// Site describes a site accessible with an API key.
+type Site struct {
+	ID       string       `json:"id"`
+	Name     string       `json:"name"`
+	Address  *SiteAddress `json:"address,omitempty"`
+	Timezone string       `json:"timezone"`
+}
+
+func retrieveSites(apiKey string) ([]Site, error) {
+	var sites []Site
+	if err := retrieve("sites", sitesURL, apiKey, &sites); err != nil {
+		return nil, err
+	}
+
+	return sites, nil
+}
+
+func (a *SiteAddress) String() string {
+	if a == nil {
+		return ""
+	}
+
+	var parts []string
+	for _, p := range []string{a.Street, strings.TrimSpace(a.PostalCode + " " + a.City), a.Country} {
+		if len(p) > 0 {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// runListSites prints all sites accessible with the API key.
+func runListSites(args []string) int {
+	fs := flag.NewFlagSet("list-sites", flag.ExitOnError)
+	format := fs.String("format", "table", "Output format (table or json)")
+	fs.Parse(args)
+
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown format %q\n", *format)
+		return 1
+	}
+
+	apiKey := os.Getenv("NTUITY_API_KEY")
+	if len(apiKey) == 0 {
+		fmt.Fprintf(os.Stderr, "No api key given\n")
+		return 1
+	}
+
+	sites, err := retrieveSites(apiKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list sites: %v\n", err)
+		return 1
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(sites)
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "ID\tNAME\tADDRESS\tTIMEZONE\n")
+	for _, site := range sites {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", site.ID, site.Name, site.Address, site.Timezone)
+	}
+	tw.Flush()
+
+	return 0
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// siteSoCBands holds the time a site's storages spent in each state of
+// charge band.
+type siteSoCBands struct {
+	LastTime time.Time          `json:"last_time"`
+	LastSoC  float64            `json:"last_soc"`
+	Seconds  map[string]float64 `json:"seconds"`
+}
+
+// socBandTracker accounts the time between two samples to the state of charge
+// band the storages were in at the first sample.
+type socBandTracker struct {
+	mu     sync.Mutex
+	bounds []float64
+	sites  map[string]*siteSoCBands
+	config *configStore
+	desc   *prometheus.Desc
+}
+
+// parseSoCBands parses a comma separated list of ascending state of charge
+// bounds in percent.
+func parseSoCBands(s string) ([]float64, error) {
+	var bounds []float64
+	for _, f := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state of charge bound %q", f)
+		}
+		if b <= 0 || b >= 100 {
+			return nil, fmt.Errorf("state of charge bound %v not between 0 and 100", b)
+		}
+		// Equal bounds would give the same band twice.
+		if len(bounds) > 0 && b <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("state of charge bounds not strictly ascending")
+		}
+		bounds = append(bounds, b)
+	}
+
+	return bounds, nil
+}
+
+func newSoCBandTracker(reg *prometheus.Registry, config *configStore, bounds []float64) *socBandTracker {
+	t := &socBandTracker{
+		bounds: bounds,
+		sites:  make(map[string]*siteSoCBands),
+		config: config,
+		desc: prometheus.NewDesc(
+			"ntuity_storage_soc_band_seconds_total",
+			"Time in seconds the state of charge of all storages spent in the given band (in percent)",
+			[]string{"site", "band"}, nil,
+		),
+	}
+
+	reg.MustRegister(t)
+
+	config.onRemoveSite(func(site string) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.sites, site)
+	})
+
+	return t
+}
+
+func (t *socBandTracker) band(soc float64) string {
+	lower := 0.0
+	for _, b := range t.bounds {
+		if soc < b {
+			return fmt.Sprintf("%g-%g", lower, b)
+		}
+		lower = b
+	}
+	return fmt.Sprintf("%g-100", lower)
+}
+
+func (t *socBandTracker) observe(site string, flow *EnergyFlow) {
+	if flow.StateOfCharge.Value == nil {
+		return
+	}
+
+	now := flow.StateOfCharge.Time
+	soc := *flow.StateOfCharge.Value
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sites[site]
+	if !ok {
+		s = &siteSoCBands{Seconds: make(map[string]float64)}
+		t.sites[site] = s
+	}
+
+	dt := now.Sub(s.LastTime)
+	if ok && dt <= 0 {
+		return
+	}
+
+	if ok && dt <= maxIntegrationGap {
+		s.Seconds[t.band(s.LastSoC)] += dt.Seconds()
+	}
+
+	s.LastTime = now
+	s.LastSoC = soc
+}
+
+func (t *socBandTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.desc
+}
+
+func (t *socBandTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for site, s := range t.sites {
+		for _, band := range t.bands() {
+			ch <- prometheus.MustNewConstMetric(t.desc, prometheus.CounterValue, s.Seconds[band], site, band)
+		}
+	}
+}
+
+// bands returns the names of all tracked bands.
+func (t *socBandTracker) bands() []string {
+	names := []string{t.band(0)}
+	for _, b := range t.bounds {
+		names = append(names, t.band(b))
+	}
+	return names
+}
+
+func (t *socBandTracker) saveState(s *state) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.SoCBands = make(map[string]*siteSoCBands)
+	for site, bands := range t.sites {
+		copied := *bands
+		copied.Seconds = copyValues(bands.Seconds)
+		s.SoCBands[site] = &copied
+	}
+}
+
+func (t *socBandTracker) restoreState(s *state) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cfg := t.config.get()
+	for site, bands := range s.SoCBands {
+		if !cfg.hasSite(site) {
+			continue
+		}
+		if bands.Seconds == nil {
+			bands.Seconds = make(map[string]float64)
+		}
+		t.sites[site] = bands
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSoCBands(t *testing.T) {
+	for _, c := range []struct {
+		bands string
+		want  []float64
+	}{
+		{"10,90", []float64{10, 90}},
+		{"20, 50, 80", []float64{20, 50, 80}},
+		{"50", []float64{50}},
+		{"10,10", nil},
+		{"50,20", nil},
+		{"0,50", nil},
+		{"50,100", nil},
+		{"10,x", nil},
+	} {
+		got, err := parseSoCBands(c.bands)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("parseSoCBands(%q) = %v, want error", c.bands, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseSoCBands(%q) = %v, %v, want %v", c.bands, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// state holds everything which is persisted to the state file so that
+// derived counters survive restarts and upgrades of the collector.
+type state struct {
+	Paused   []string                     `json:"paused,omitempty"`
+	Energy   map[string]*siteEnergy       `json:"energy,omitempty"`
+	SoCBands map[string]*siteSoCBands     `json:"soc_bands,omitempty"`
+	Tariffs  map[string]*siteTariffEnergy `json:"tariffs,omitempty"`
+	Prices   map[string]*sitePrices       `json:"prices,omitempty"`
+	Weather  map[string]*siteWeather      `json:"weather,omitempty"`
+
+	Baselines map[string]*siteBaseline `json:"baselines,omitempty"`
+
+	APIAvailability map[string]*endpointAvailability `json:"api_availability,omitempty"`
+}
+
+// stateful is implemented by everything keeping parts of its state in the
+// state file.
+type stateful interface {
+	saveState(s *state)
+	restoreState(s *state)
+}
+
+func restoreState(path string, persisted []stateful) error {
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var s state
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+
+	for _, p := range persisted {
+		p.restoreState(&s)
+	}
+
+	return nil
+}
+
+// saveState writes the state atomically by replacing the state file with a
+// completely written temporary file.
+func saveState(path string, persisted []stateful) error {
+	var s state
+	for _, p := range persisted {
+		p.saveState(&s)
+	}
+
+	bs, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func persistState(path string, persisted []stateful, reporter *errorReporter) {
+	defer reporter.recoverPanic("")
+	for {
+		time.Sleep(time.Second * 60)
+
+		if err := saveState(path, persisted); err != nil {
+			logError("Failed to save state: %v", err)
+		}
+	}
+}
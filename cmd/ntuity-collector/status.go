@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusRetryInterval is the interval in which the status endpoint is tried
+// again for sites for which it isn't available.
+const statusRetryInterval = time.Hour
+
+// SiteStatus is the response of the status endpoint of the API, describing
+// the connection of the site's gateway to the ntuity cloud.
+type SiteStatus struct {
+	Online            *bool     `json:"online"`
+	LastCommunication time.Time `json:"last_communication"`
+}
+
+func retrieveSiteStatus(siteURL, apiKey string) (*SiteStatus, error) {
+	var status SiteStatus
+	if err := retrieve("status", siteURL, apiKey, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// siteStatusCollector exports the connection state of the gateway of each
+// site, so a site gateway being offline can be told apart from problems of
+// the ntuity cloud API.
+type siteStatusCollector struct {
+	mu          sync.Mutex
+	unavailable map[string]time.Time
+	config      *configStore
+
+	online            *prometheus.GaugeVec
+	lastCommunication *prometheus.GaugeVec
+	lastSample        *prometheus.GaugeVec
+}
+
+func newSiteStatusCollector(reg *prometheus.Registry, config *configStore) *siteStatusCollector {
+	c := &siteStatusCollector{
+		unavailable: make(map[string]time.Time),
+		config:      config,
+		online: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "site_gateway_online",
+				Help:      "Whether the gateway of the site is connected to the ntuity cloud (1) or not (0)",
+			},
+			[]string{"site"},
+		),
+		lastCommunication: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "site_last_communication_timestamp_seconds",
+				Help:      "Time of the last communication of the site's gateway with the ntuity cloud",
+			},
+			[]string{"site"},
+		),
+		lastSample: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "site_last_sample_timestamp_seconds",
+				Help:      "Time of the most recent value in the energy flow of the site",
+			},
+			[]string{"site"},
+		),
+	}
+
+	reg.MustRegister(c.online, c.lastCommunication, c.lastSample)
+
+	config.onRemoveSite(func(site string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.unavailable, site)
+		c.online.DeleteLabelValues(site)
+		c.lastCommunication.DeleteLabelValues(site)
+		c.lastSample.DeleteLabelValues(site)
+	})
+
+	return c
+}
+
+func (c *siteStatusCollector) observe(site string, flow *EnergyFlow) {
+	if t := flow.timestamp(); !t.IsZero() {
+		c.lastSample.WithLabelValues(site).Set(float64(t.Unix()))
+	}
+
+	cfg := c.config.get()
+	siteConfig, ok := cfg.site(site)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	since, unavailable := c.unavailable[site]
+	c.mu.Unlock()
+	if unavailable && time.Since(since) < statusRetryInterval {
+		return
+	}
+
+	status, err := retrieveSiteStatus(fmt.Sprintf(statusURL, site), cfg.apiKey(siteConfig))
+	if err != nil {
+		if isNotAvailable(err) {
+			c.mu.Lock()
+			c.unavailable[site] = time.Now()
+			c.mu.Unlock()
+		} else {
+			logError("Failed to retrieve status of site %s: %v", site, err)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.unavailable, site)
+	c.mu.Unlock()
+
+	if status.Online != nil {
+		if *status.Online {
+			c.online.WithLabelValues(site).Set(1)
+		} else {
+			c.online.WithLabelValues(site).Set(0)
+		}
+	}
+	if !status.LastCommunication.IsZero() {
+		c.lastCommunication.WithLabelValues(site).Set(float64(status.LastCommunication.Unix()))
+	}
+}
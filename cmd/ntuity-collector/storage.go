@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// minStoragePower is the storage power in W below which the storages of a
+// site are considered idle.
+const minStoragePower = 10
+
+// storageEstimator estimates the time until the storages of a site are empty
+// or full at their current power.
+type storageEstimator struct {
+	config      *configStore
+	timeToEmpty *prometheus.GaugeVec
+	timeToFull  *prometheus.GaugeVec
+}
+
+func newStorageEstimator(reg *prometheus.Registry, config *configStore) *storageEstimator {
+	e := &storageEstimator{
+		config: config,
+		timeToEmpty: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "storage_time_to_empty_minutes",
+				Help:      "Estimated time in minutes until the storages are empty at the current discharge power",
+			},
+			[]string{"site"},
+		),
+		timeToFull: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "storage_time_to_full_minutes",
+				Help:      "Estimated time in minutes until the storages are full at the current charge power",
+			},
+			[]string{"site"},
+		),
+	}
+
+	reg.MustRegister(e.timeToEmpty, e.timeToFull)
+
+	config.onRemoveSite(e.delete)
+
+	return e
+}
+
+func (e *storageEstimator) delete(site string) {
+	e.timeToEmpty.DeleteLabelValues(site)
+	e.timeToFull.DeleteLabelValues(site)
+}
+
+func (e *storageEstimator) observe(site string, flow *EnergyFlow) {
+	siteConfig, ok := e.config.get().site(site)
+	if !ok || siteConfig.StorageCapacity <= 0 || flow.StateOfCharge.Value == nil {
+		e.delete(site)
+		return
+	}
+
+	// The storage power is positive while discharging and negative while
+	// charging.
+	power := flow.PowerStorage.float()
+	stored := siteConfig.StorageCapacity * *flow.StateOfCharge.Value / 100
+
+	switch {
+	case power >= minStoragePower:
+		e.timeToEmpty.WithLabelValues(site).Set(stored / power * 60)
+		e.timeToFull.DeleteLabelValues(site)
+	case power <= -minStoragePower:
+		e.timeToFull.WithLabelValues(site).Set(positive(siteConfig.StorageCapacity-stored) / -power * 60)
+		e.timeToEmpty.DeleteLabelValues(site)
+	default:
+		e.delete(site)
+	}
+}
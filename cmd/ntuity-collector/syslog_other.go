@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+func newSyslogWriter(network, raddr string) (io.Writer, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
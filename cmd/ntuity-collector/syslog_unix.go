@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// syslogWriter sends log messages to a local or remote syslog daemon.
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func newSyslogWriter(network, raddr string) (io.Writer, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	if err := w.writePriority(priorityInfo, strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) writePriority(priority int, msg string) error {
+	switch priority {
+	case priorityErr:
+		return w.w.Err(msg)
+	case priorityWarning:
+		return w.w.Warning(msg)
+	default:
+		return w.w.Info(msg)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultTariffBucket = "offpeak"
+
+// TariffConfig describes a time-of-use tariff. Energy is accounted to the
+// bucket of the first matching period or the default bucket.
+type TariffConfig struct {
+	DefaultBucket string         `json:"default_bucket,omitempty"`
+	Periods       []TariffPeriod `json:"periods"`
+}
+
+// TariffPeriod is a daily recurring period from Start to End (time of day in
+// the time zone of the site in the format 15:04). Periods ending before they
+// start span midnight. Without weekdays ("mon" to "sun") a period applies to
+// every day.
+type TariffPeriod struct {
+	Bucket   string   `json:"bucket"`
+	Weekdays []string `json:"weekdays,omitempty"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (t *TariffConfig) validate() error {
+	for _, p := range t.Periods {
+		if len(p.Bucket) == 0 {
+			return fmt.Errorf("tariff period without bucket given")
+		}
+		for _, d := range p.Weekdays {
+			if _, ok := weekdays[strings.ToLower(d)]; !ok {
+				return fmt.Errorf("invalid weekday %q in tariff period", d)
+			}
+		}
+		if _, err := time.Parse("15:04", p.Start); err != nil {
+			return fmt.Errorf("invalid start %q of tariff period", p.Start)
+		}
+		if _, err := time.Parse("15:04", p.End); err != nil {
+			return fmt.Errorf("invalid end %q of tariff period", p.End)
+		}
+	}
+	return nil
+}
+
+// bucket returns the tariff bucket at the given time in its location.
+func (t *TariffConfig) bucket(at time.Time) string {
+	minute := at.Hour()*60 + at.Minute()
+
+	for _, p := range t.Periods {
+		start, _ := time.Parse("15:04", p.Start)
+		end, _ := time.Parse("15:04", p.End)
+		startMinute := start.Hour()*60 + start.Minute()
+		endMinute := end.Hour()*60 + end.Minute()
+
+		// The weekday of a period spanning midnight is the one it started on.
+		day := at.Weekday()
+		var matches bool
+		if startMinute <= endMinute {
+			matches = minute >= startMinute && minute < endMinute
+		} else if minute >= startMinute {
+			matches = true
+		} else if minute < endMinute {
+			matches = true
+			day = (day + 6) % 7
+		}
+
+		if matches && p.appliesOn(day) {
+			return p.Bucket
+		}
+	}
+
+	if len(t.DefaultBucket) > 0 {
+		return t.DefaultBucket
+	}
+	return defaultTariffBucket
+}
+
+func (p TariffPeriod) appliesOn(day time.Weekday) bool {
+	if len(p.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range p.Weekdays {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// siteTariffEnergy holds the grid energy of a site per tariff bucket and
+// direction.
+type siteTariffEnergy struct {
+	powerIntegrator
+	Energy map[string]map[string]float64 `json:"energy"`
+}
+
+// tariffCounters accounts the energy imported from and exported to the grid
+// to the buckets of the time-of-use tariff configured for a site.
+type tariffCounters struct {
+	mu     sync.Mutex
+	sites  map[string]*siteTariffEnergy
+	config *configStore
+	desc   *prometheus.Desc
+}
+
+func newTariffCounters(reg *prometheus.Registry, config *configStore) *tariffCounters {
+	c := &tariffCounters{
+		sites:  make(map[string]*siteTariffEnergy),
+		config: config,
+		desc: prometheus.NewDesc(
+			"ntuity_tariff_energy_wh_total",
+			"Energy in Wh imported from or exported to the grid per time-of-use tariff bucket",
+			[]string{"site", "bucket", "direction"}, nil,
+		),
+	}
+
+	reg.MustRegister(c)
+
+	config.onRemoveSite(func(site string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.sites, site)
+	})
+
+	return c
+}
+
+func (c *tariffCounters) observe(site string, flow *EnergyFlow) {
+	siteConfig, ok := c.config.get().site(site)
+	if !ok || siteConfig.Tariff == nil {
+		return
+	}
+
+	grid := flow.PowerGrid.float()
+	power := map[string]float64{
+		"import": positive(grid),
+		"export": positive(-grid),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.sites[site]
+	if !ok {
+		s = &siteTariffEnergy{Energy: make(map[string]map[string]float64)}
+		c.sites[site] = s
+	}
+
+	// The energy since the previous sample is accounted to the bucket which
+	// was active when it was taken.
+	bucket := siteConfig.Tariff.bucket(s.LastTime.In(siteConfig.timeLocation()))
+
+	energy, _ := s.step(flow.PowerGrid.Time, power)
+	if energy == nil {
+		return
+	}
+
+	if s.Energy[bucket] == nil {
+		s.Energy[bucket] = make(map[string]float64)
+	}
+	for direction, wh := range energy {
+		s.Energy[bucket][direction] += wh
+	}
+}
+
+func (c *tariffCounters) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *tariffCounters) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for site, s := range c.sites {
+		for bucket, energy := range s.Energy {
+			for direction, wh := range energy {
+				ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, wh, site, bucket, direction)
+			}
+		}
+	}
+}
+
+func (c *tariffCounters) saveState(s *state) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s.Tariffs = make(map[string]*siteTariffEnergy)
+	for site, tariff := range c.sites {
+		copied := &siteTariffEnergy{
+			powerIntegrator: tariff.powerIntegrator,
+			Energy:          make(map[string]map[string]float64),
+		}
+		copied.LastPower = copyValues(tariff.LastPower)
+		for bucket, energy := range tariff.Energy {
+			copied.Energy[bucket] = copyValues(energy)
+		}
+		s.Tariffs[site] = copied
+	}
+}
+
+func (c *tariffCounters) restoreState(s *state) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg := c.config.get()
+	for site, tariff := range s.Tariffs {
+		if !cfg.hasSite(site) {
+			continue
+		}
+		if tariff.Energy == nil {
+			tariff.Energy = make(map[string]map[string]float64)
+		}
+		c.sites[site] = tariff
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTariffBucket(t *testing.T) {
+	tariff := &TariffConfig{
+		Periods: []TariffPeriod{
+			{Bucket: "peak", Weekdays: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "07:00", End: "21:00"},
+			{Bucket: "weekend_night", Weekdays: []string{"Sat"}, Start: "22:00", End: "06:00"},
+		},
+	}
+	vienna := SiteConfig{Timezone: "Europe/Vienna"}.timeLocation()
+	utc := func(s string) time.Time {
+		at, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+
+	for _, c := range []struct {
+		name string
+		at   time.Time
+		want string
+	}{
+		{"before peak", time.Date(2024, 3, 4, 6, 59, 0, 0, vienna), "offpeak"},
+		{"start of peak", time.Date(2024, 3, 4, 7, 0, 0, 0, vienna), "peak"},
+		{"end of peak", time.Date(2024, 3, 4, 20, 59, 0, 0, vienna), "peak"},
+		{"after peak", time.Date(2024, 3, 4, 21, 0, 0, 0, vienna), "offpeak"},
+		{"weekend without peak", time.Date(2024, 3, 2, 12, 0, 0, 0, vienna), "offpeak"},
+
+		// A period spanning midnight applies on the weekday it starts on.
+		{"saturday night before midnight", time.Date(2024, 3, 2, 22, 30, 0, 0, vienna), "weekend_night"},
+		{"saturday night after midnight", time.Date(2024, 3, 3, 5, 59, 0, 0, vienna), "weekend_night"},
+		{"end of saturday night", time.Date(2024, 3, 3, 6, 0, 0, 0, vienna), "offpeak"},
+		{"sunday night", time.Date(2024, 3, 3, 22, 30, 0, 0, vienna), "offpeak"},
+		{"friday night after midnight", time.Date(2024, 3, 2, 5, 0, 0, 0, vienna), "offpeak"},
+
+		// Periods refer to the time zone of the site, not the one of the time.
+		{"utc before peak", utc("2024-03-04T05:59:00Z").In(vienna), "offpeak"},
+		{"utc in peak", utc("2024-03-04T06:30:00Z").In(vienna), "peak"},
+		{"utc in peak after spring forward", utc("2024-04-01T05:30:00Z").In(vienna), "peak"},
+		{"utc before peak after spring forward", utc("2024-04-01T04:30:00Z").In(vienna), "offpeak"},
+		{"utc in peak after fall back", utc("2024-10-28T06:30:00Z").In(vienna), "peak"},
+		{"utc before peak after fall back", utc("2024-10-28T05:30:00Z").In(vienna), "offpeak"},
+
+		// The nights of the DST changes are an hour shorter or longer.
+		{"spring forward night", utc("2024-03-31T01:30:00Z").In(vienna), "weekend_night"},
+		{"end of spring forward night", utc("2024-03-31T04:00:00Z").In(vienna), "offpeak"},
+		{"fall back night, first 02:30", utc("2024-10-27T00:30:00Z").In(vienna), "weekend_night"},
+		{"fall back night, second 02:30", utc("2024-10-27T01:30:00Z").In(vienna), "weekend_night"},
+		{"end of fall back night", utc("2024-10-27T05:00:00Z").In(vienna), "offpeak"},
+	} {
+		if got := tariff.bucket(c.at); got != c.want {
+			t.Errorf("%s: bucket(%v) = %s, want %s", c.name, c.at, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TenantConfig describes a tenant with its own metrics endpoint at
+// /tenants/<name>/metrics, protected by basic auth.
+type TenantConfig struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (c *Config) tenant(name string) (TenantConfig, bool) {
+	for _, t := range c.Tenants {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return TenantConfig{}, false
+}
+
+func (c *Config) validateTenants() error {
+	seen := make(map[string]bool)
+	for _, t := range c.Tenants {
+		if len(t.Name) == 0 || strings.Contains(t.Name, "/") {
+			return fmt.Errorf("invalid tenant name %q", t.Name)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("tenant %s given more than once", t.Name)
+		}
+		seen[t.Name] = true
+
+		if len(t.Username) == 0 || len(t.Password) == 0 {
+			return fmt.Errorf("no credentials given for tenant %s", t.Name)
+		}
+	}
+
+	for _, site := range c.Sites {
+		if len(site.Tenant) > 0 && !seen[site.Tenant] {
+			return fmt.Errorf("unknown tenant %s given for site %s", site.Tenant, site.ID)
+		}
+	}
+
+	return nil
+}
+
+// siteFilter only passes on metrics of the given sites. The labels of the
+// sites are left out, as their label names are the ones of all sites.
+type siteFilter struct {
+	gatherer prometheus.Gatherer
+	sites    map[string]bool
+}
+
+func (f *siteFilter) Gather() ([]*dto.MetricFamily, error) {
+	families, err := f.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []*dto.MetricFamily
+	for _, family := range families {
+		if family.GetName() == siteLabelsName {
+			continue
+		}
+
+		var metrics []*dto.Metric
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "site" && f.sites[l.GetValue()] {
+					metrics = append(metrics, m)
+					break
+				}
+			}
+		}
+
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			filtered = append(filtered, family)
+		}
+	}
+
+	return filtered, nil
+}
+
+// registerTenantHandlers serves the metrics of the sites of every tenant at
+// /tenants/<name>/metrics and, given the local storage, their samples through
+// the remote-read API at /tenants/<name>/api/v1/read.
+func registerTenantHandlers(reg *prometheus.Registry, config *configStore, storage *localStorage) {
+	http.HandleFunc("/tenants/", tenantHandler(reg, config, storage))
+}
+
+func tenantHandler(reg *prometheus.Registry, config *configStore, storage *localStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/tenants/")
+		i := strings.Index(path, "/")
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		name, endpoint := path[:i], path[i:]
+		if endpoint != "/metrics" && (endpoint != "/api/v1/read" || storage == nil) {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Unknown tenants are answered like wrong credentials, so that the
+		// names of the tenants can't be probed.
+		cfg := config.get()
+		tenant, ok := cfg.tenant(name)
+		username, password, auth := r.BasicAuth()
+		if !ok || !auth || !equalSecret(username, tenant.Username) || !equalSecret(password, tenant.Password) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", "tenant "+name))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		sites := make(map[string]bool)
+		var tenantSites []SiteConfig
+		for _, site := range cfg.Sites {
+			if site.Tenant == tenant.Name {
+				sites[site.ID] = true
+				tenantSites = append(tenantSites, site)
+			}
+		}
+
+		if endpoint == "/api/v1/read" {
+			serveRemoteRead(w, r, storage, sites)
+			return
+		}
+
+		// The labels of the sites of the tenant are collected on their own,
+		// so that the label names of other tenants don't show up.
+		labels := prometheus.NewRegistry()
+		labels.MustRegister(&siteLabels{sites: func() []SiteConfig {
+			return tenantSites
+		}})
+
+		gatherer := prometheus.Gatherers{&siteFilter{gatherer: reg, sites: sites}, labels}
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
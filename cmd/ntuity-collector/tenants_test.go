@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTenantHandler(t *testing.T) {
+	config := newConfigStore(&Config{
+		APIKey: "key",
+		Sites: []SiteConfig{
+			{ID: "a", Tenant: "acme", Labels: map[string]string{"region": "east"}},
+			{ID: "b", Tenant: "other", Labels: map[string]string{"customer": "other"}},
+			{ID: "c"},
+		},
+		Tenants: []TenantConfig{
+			{Name: "acme", Username: "acme", Password: "acme-password"},
+			{Name: "other", Username: "other", Password: "other-password"},
+		},
+	})
+
+	reg := prometheus.NewRegistry()
+	newSiteLabels(reg, config)
+	power := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ntuity_power_grid"}, []string{"site"})
+	reg.MustRegister(power)
+	for _, site := range []string{"a", "b", "c"} {
+		power.WithLabelValues(site).Set(100)
+	}
+
+	handler := tenantHandler(reg, config, nil)
+	get := func(path, username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if len(username) > 0 {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	for _, c := range []struct {
+		name               string
+		path               string
+		username, password string
+		want               int
+	}{
+		{"no credentials", "/tenants/acme/metrics", "", "", http.StatusUnauthorized},
+		{"wrong password", "/tenants/acme/metrics", "acme", "other-password", http.StatusUnauthorized},
+		{"credentials of another tenant", "/tenants/acme/metrics", "other", "other-password", http.StatusUnauthorized},
+		// Unknown tenants are rejected like wrong credentials.
+		{"unknown tenant", "/tenants/nobody/metrics", "acme", "acme-password", http.StatusUnauthorized},
+		{"unknown endpoint", "/tenants/acme/config", "acme", "acme-password", http.StatusNotFound},
+		// There's no remote-read endpoint without the local storage.
+		{"no local storage", "/tenants/acme/api/v1/read", "acme", "acme-password", http.StatusNotFound},
+	} {
+		if rec := get(c.path, c.username, c.password); rec.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", c.name, rec.Code, c.want)
+		}
+	}
+
+	rec := get("/tenants/acme/metrics", "acme", "acme-password")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`ntuity_power_grid{site="a"} 100`,
+		`ntuity_site_labels{label_region="east",site="a"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("%s missing in metrics of tenant:\n%s", want, body)
+		}
+	}
+	// Neither the sites of other tenants nor their label names show up.
+	for _, unwanted := range []string{`site="b"`, `site="c"`, "customer"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("%s in metrics of tenant:\n%s", unwanted, body)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// siteView holds the values shown for a site in the live view.
+type siteView struct {
+	site        string
+	values      map[string]float64
+	paused      bool
+	offline     bool
+	outage      bool
+	unreachable error
+}
+
+// topMetrics maps the metrics shown in the live view to their column.
+var topMetrics = []struct {
+	metric string
+	column string
+	unit   string
+}{
+	{"ntuity_power_production", "PRODUCTION", "W"},
+	{"ntuity_power_consumption_calc", "CONSUMPTION", "W"},
+	{"ntuity_power_grid", "GRID", "W"},
+	{"ntuity_power_storage", "STORAGE", "W"},
+	{"ntuity_state_of_charge", "SOC", "%"},
+}
+
+// topClient is used to scrape the metrics endpoint of the running collector.
+var topClient = &http.Client{Timeout: 10 * time.Second}
+
+// scrapeCollector retrieves the current values of all sites from the metrics
+// endpoint of a running collector.
+func scrapeCollector(url string) ([]*siteView, error) {
+	res, err := topClient.Get(strings.TrimSuffix(url, "/") + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %d", res.StatusCode)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	views := make(map[string]*siteView)
+	view := func(m *dto.Metric) *siteView {
+		var site string
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "site" {
+				site = l.GetValue()
+			}
+		}
+		if _, ok := views[site]; !ok {
+			views[site] = &siteView{site: site, values: make(map[string]float64)}
+		}
+		return views[site]
+	}
+
+	for _, m := range topMetrics {
+		for _, metric := range families[m.metric].GetMetric() {
+			view(metric).values[m.metric] = metric.GetGauge().GetValue()
+		}
+	}
+	for _, metric := range families["ntuity_site_paused"].GetMetric() {
+		view(metric).paused = metric.GetGauge().GetValue() == 1
+	}
+	for _, metric := range families["ntuity_site_gateway_online"].GetMetric() {
+		view(metric).offline = metric.GetGauge().GetValue() == 0
+	}
+	for _, metric := range families["ntuity_grid_outage_active"].GetMetric() {
+		view(metric).outage = metric.GetGauge().GetValue() == 1
+	}
+
+	var result []*siteView
+	for _, v := range views {
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].site < result[j].site
+	})
+
+	return result, nil
+}
+
+// pollSites retrieves the current values of the sites directly from the API.
+func pollSites(sites []string, apiKey string) []*siteView {
+	var result []*siteView
+	for _, site := range sites {
+		v := &siteView{site: site, values: make(map[string]float64)}
+		result = append(result, v)
+
+		flow, err := retrieveEnergyFlow(http.DefaultClient, fmt.Sprintf(baseURL, site), apiKey)
+		if err != nil {
+			v.unreachable = err
+			continue
+		}
+
+		v.values["ntuity_power_production"] = flow.PowerProduction.float()
+		v.values["ntuity_power_consumption_calc"] = flow.PowerConsumptionCalc.float()
+		v.values["ntuity_power_grid"] = flow.PowerGrid.float()
+		v.values["ntuity_power_storage"] = flow.PowerStorage.float()
+		v.values["ntuity_state_of_charge"] = flow.StateOfCharge.float()
+		v.outage = gridOutage(flow)
+	}
+	return result
+}
+
+func (v *siteView) status() string {
+	switch {
+	case v.unreachable != nil:
+		return "error: " + v.unreachable.Error()
+	case v.paused:
+		return "paused"
+	case v.offline:
+		return "gateway offline"
+	case v.outage:
+		return "grid outage"
+	default:
+		return "ok"
+	}
+}
+
+func renderTop(w io.Writer, source string, views []*siteView, err error) {
+	// Clear the screen and move the cursor to the top left corner.
+	fmt.Fprint(w, "\033[H\033[2J")
+	fmt.Fprintf(w, "ntuity-collector top - %s - %s\n\n", source, time.Now().Format("15:04:05"))
+
+	if err != nil {
+		fmt.Fprintf(w, "Failed to retrieve values: %v\n", err)
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "SITE\t")
+	for _, m := range topMetrics {
+		fmt.Fprintf(tw, "%s\t", m.column)
+	}
+	fmt.Fprint(tw, "STATUS\n")
+
+	for _, v := range views {
+		fmt.Fprintf(tw, "%s\t", v.site)
+		for _, m := range topMetrics {
+			if value, ok := v.values[m.metric]; ok {
+				fmt.Fprintf(tw, "%.0f %s\t", value, m.unit)
+			} else {
+				fmt.Fprint(tw, "-\t")
+			}
+		}
+		fmt.Fprintf(tw, "%s\n", v.status())
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nGrid: + import / - export, storage: + discharging / - charging. Press Ctrl-C to quit.\n")
+}
+
+// runTop shows a live view of all sites in the terminal, either from a
+// running collector or polling the API directly.
+func runTop(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	collectorURL := fs.String("collector-url", "http://127.0.0.1:8080", "URL of the running collector to show the values of")
+	sites := fs.String("site-id", "", "Poll the given sites (comma separated) directly from the API instead of a running collector")
+	interval := fs.Duration("interval", 5*time.Second, "Interval in which to refresh the values (defaults to the poll interval with -site-id)")
+	fs.Parse(args)
+
+	// The API is not polled more often than by the collector itself unless
+	// asked to.
+	intervalSet := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "interval" {
+			intervalSet = true
+		}
+	})
+	if len(*sites) > 0 && !intervalSet {
+		*interval = pollInterval
+	}
+
+	apiKey := os.Getenv("NTUITY_API_KEY")
+	if len(*sites) > 0 && len(apiKey) == 0 {
+		fmt.Fprintf(os.Stderr, "No api key given\n")
+		return 1
+	}
+
+	for {
+		if len(*sites) > 0 {
+			renderTop(os.Stdout, "api.ntuity.io", pollSites(strings.Split(*sites, ","), apiKey), nil)
+		} else {
+			views, err := scrapeCollector(*collectorURL)
+			renderTop(os.Stdout, *collectorURL, views, err)
+		}
+
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// segmentDuration is the time span after which a new segment file is
+	// started. Segments are deleted as a whole once they are out of the
+	// retention period.
+	segmentDuration = 24 * time.Hour
+
+	// trimInterval is the interval in which segments out of the retention
+	// period are deleted.
+	trimInterval = time.Hour
+)
+
+// Record types of segment files.
+const (
+	recordSeries  = 1
+	recordSamples = 2
+)
+
+// tsdbLabel is a label of a series, including the metric name as __name__.
+type tsdbLabel struct {
+	name, value string
+}
+
+type tsdbSample struct {
+	t int64
+	v float64
+}
+
+type tsdbSeries struct {
+	labels  []tsdbLabel
+	samples []tsdbSample
+}
+
+// localStorage keeps the samples of all metrics for the retention period in
+// append-only segment files and reads them back for queries, so that its
+// memory usage doesn't grow with the number of samples. Each segment starts
+// with an empty series table and defines the series (as an ID and its labels)
+// before their first sample in it. Records are prefixed with their length, so
+// that a record torn by a crash ends the segment.
+type localStorage struct {
+	mu        sync.Mutex
+	dir       string
+	retention time.Duration
+	lastTrim  time.Time
+
+	segment      *os.File
+	w            *bufio.Writer
+	segmentStart time.Time
+	segmentIDs   map[string]uint64
+}
+
+func openLocalStorage(dir string, retention time.Duration) (*localStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &localStorage{
+		dir:       dir,
+		retention: retention,
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the segment written last can be torn by a crash, as a new segment
+	// is started at every start.
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		err := scanSegment(last.path, last.size, func(record []byte) error {
+			return nil
+		})
+		if err != nil {
+			logWarning("Skipping torn record at the end of %s: %v", last.path, err)
+		}
+	}
+
+	s.deleteSegments(segments, time.Now())
+
+	return s, nil
+}
+
+type segmentFile struct {
+	path  string
+	start time.Time
+	size  int64
+}
+
+// segments returns the segment files sorted by their start, which is encoded
+// in their name in milliseconds since the epoch.
+func (s *localStorage) segments() ([]segmentFile, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segmentFile
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".seg") {
+			continue
+		}
+		ms, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segmentFile{
+			path:  filepath.Join(s.dir, f.Name()),
+			start: time.Unix(0, ms*int64(time.Millisecond)),
+			size:  f.Size(),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].start.Before(segments[j].start)
+	})
+
+	return segments, nil
+}
+
+// deleteSegments deletes the segments which only contain samples out of the
+// retention period, i.e. the ones followed by a segment starting before it.
+func (s *localStorage) deleteSegments(segments []segmentFile, now time.Time) {
+	cutoff := now.Add(-s.retention)
+	for i := 0; i+1 < len(segments); i++ {
+		if !segments[i+1].start.Before(cutoff) {
+			break
+		}
+		if err := os.Remove(segments[i].path); err != nil {
+			logError("Failed to delete segment: %v", err)
+		}
+	}
+}
+
+func seriesKey(labels []tsdbLabel) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.name)
+		b.WriteByte(0xff)
+		b.WriteString(l.value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// errTornRecord is returned by scanSegment for a record cut off by a crash.
+var errTornRecord = errors.New("torn record")
+
+// scanSegment calls fn for every record in the first size bytes of the
+// segment. A torn record ends the scan with errTornRecord.
+func scanSegment(path string, size int64, fn func(record []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(io.LimitReader(f, size))
+	for {
+		record, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: %v", errTornRecord, err)
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n > 64<<20 {
+		return nil, fmt.Errorf("invalid record length %d", n)
+	}
+
+	record := make([]byte, n)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *localStorage) writeRecord(record []byte) error {
+	if _, err := s.w.Write(binary.AppendUvarint(nil, uint64(len(record)))); err != nil {
+		return err
+	}
+	_, err := s.w.Write(record)
+	return err
+}
+
+// decoder decodes the fields of a record, remembering the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+var errShortRecord = errors.New("short record")
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errShortRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errShortRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.b)) < n {
+		d.err = errShortRecord
+		return ""
+	}
+	v := string(d.b[:n])
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) float() float64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = errShortRecord
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.b))
+	d.b = d.b[8:]
+	return v
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// startSegment closes the current segment and starts a new one.
+func (s *localStorage) startSegment(now time.Time) error {
+	if s.segment != nil {
+		s.w.Flush()
+		s.segment.Close()
+		s.segment = nil
+	}
+
+	ms := now.UnixNano() / int64(time.Millisecond)
+	f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%d.seg", ms)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	s.segment = f
+	s.w = bufio.NewWriter(f)
+	s.segmentStart = now
+	s.segmentIDs = make(map[string]uint64)
+	return nil
+}
+
+// metricLabels returns the labels of all series of the metric families.
+func metricLabels(families []*dto.MetricFamily) ([][]tsdbLabel, []float64) {
+	var labels [][]tsdbLabel
+	var values []float64
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var v float64
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				v = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				v = m.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				v = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			l := []tsdbLabel{{name: "__name__", value: family.GetName()}}
+			for _, pair := range m.GetLabel() {
+				l = append(l, tsdbLabel{name: pair.GetName(), value: pair.GetValue()})
+			}
+			sort.Slice(l, func(i, j int) bool {
+				return l[i].name < l[j].name
+			})
+
+			labels = append(labels, l)
+			values = append(values, v)
+		}
+	}
+	return labels, values
+}
+
+// append stores the current values of the metric families.
+func (s *localStorage) append(now time.Time, families []*dto.MetricFamily) error {
+	labels, values := metricLabels(families)
+	t := now.UnixNano() / int64(time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment == nil || now.Sub(s.segmentStart) >= segmentDuration {
+		if err := s.startSegment(now); err != nil {
+			return err
+		}
+	}
+
+	samples := []byte{recordSamples}
+	samples = binary.AppendVarint(samples, t)
+	samples = binary.AppendUvarint(samples, uint64(len(labels)))
+
+	for i, l := range labels {
+		key := seriesKey(l)
+		id, ok := s.segmentIDs[key]
+		if !ok {
+			id = uint64(len(s.segmentIDs))
+			s.segmentIDs[key] = id
+
+			record := []byte{recordSeries}
+			record = binary.AppendUvarint(record, id)
+			record = binary.AppendUvarint(record, uint64(len(l)))
+			for _, label := range l {
+				record = appendString(record, label.name)
+				record = appendString(record, label.value)
+			}
+			if err := s.writeRecord(record); err != nil {
+				return err
+			}
+		}
+
+		samples = binary.AppendUvarint(samples, id)
+		samples = binary.LittleEndian.AppendUint64(samples, math.Float64bits(values[i]))
+	}
+
+	if err := s.writeRecord(samples); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+
+	if now.Sub(s.lastTrim) >= trimInterval {
+		s.trim(now)
+	}
+
+	return nil
+}
+
+// trim deletes the segments out of the retention period. Samples out of it
+// in the remaining segments are skipped by queries.
+func (s *localStorage) trim(now time.Time) {
+	s.lastTrim = now
+
+	segments, err := s.segments()
+	if err != nil {
+		logError("Failed to list segments: %v", err)
+		return
+	}
+	s.deleteSegments(segments, now)
+}
+
+// snapshot returns the segments with the size of their records written so
+// far. Queries read the segments up to this size, so that they don't block
+// appending and don't see records appended meanwhile.
+func (s *localStorage) snapshot() ([]segmentFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment != nil {
+		if err := s.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	return s.segments()
+}
+
+func (s *localStorage) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment == nil {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		s.segment.Close()
+		return err
+	}
+	if err := s.segment.Sync(); err != nil {
+		s.segment.Close()
+		return err
+	}
+	return s.segment.Close()
+}
+
+// record stores the values of all metrics of the registry in every poll
+// interval.
+func (s *localStorage) record(reg *prometheus.Registry, reporter *errorReporter) {
+	defer reporter.recoverPanic("")
+	for {
+		families, err := reg.Gather()
+		if err != nil {
+			logError("Failed to gather metrics for the local storage: %v", err)
+		}
+		if err := s.append(time.Now(), families); err != nil {
+			logError("Failed to store samples: %v", err)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
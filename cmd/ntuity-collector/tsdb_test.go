@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gaugeFamily(name string, site string, v float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: proto.String("site"), Value: proto.String(site)}},
+			Gauge: &dto.Gauge{Value: proto.Float64(v)},
+		}},
+	}
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func queryName(t *testing.T, s *localStorage, name string, start, end time.Time) []*tsdbSeries {
+	t.Helper()
+	result, err := s.query(&remoteQuery{
+		start:    millis(start),
+		end:      millis(end),
+		matchers: []*labelMatcher{{typ: matchEqual, name: "__name__", value: name}},
+	})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	return result
+}
+
+func TestLocalStorageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+
+	s, err := openLocalStorage(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		families := []*dto.MetricFamily{
+			gaugeFamily("ntuity_power_grid", "a", float64(i)),
+			gaugeFamily("ntuity_power_grid", "b", float64(10+i)),
+			gaugeFamily("ntuity_power_production", "a", 100),
+		}
+		if err := s.append(now.Add(time.Duration(i)*time.Minute), families); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reopened storage starts a new segment and reads both.
+	s, err = openLocalStorage(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.append(now.Add(3*time.Minute), []*dto.MetricFamily{gaugeFamily("ntuity_power_grid", "a", 3)}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := queryName(t, s, "ntuity_power_grid", now, now.Add(time.Hour))
+	want := []*tsdbSeries{
+		{
+			labels: []tsdbLabel{{"__name__", "ntuity_power_grid"}, {"site", "a"}},
+			samples: []tsdbSample{
+				{millis(now), 0},
+				{millis(now.Add(time.Minute)), 1},
+				{millis(now.Add(2 * time.Minute)), 2},
+				{millis(now.Add(3 * time.Minute)), 3},
+			},
+		},
+		{
+			labels: []tsdbLabel{{"__name__", "ntuity_power_grid"}, {"site", "b"}},
+			samples: []tsdbSample{
+				{millis(now), 10},
+				{millis(now.Add(time.Minute)), 11},
+				{millis(now.Add(2 * time.Minute)), 12},
+			},
+		},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+
+	// The time range is inclusive on both ends.
+	result = queryName(t, s, "ntuity_power_grid", now.Add(time.Minute), now.Add(2*time.Minute))
+	if len(result) != 2 || len(result[0].samples) != 2 || len(result[1].samples) != 2 {
+		t.Errorf("got %+v, want two series with two samples each", result)
+	}
+
+	if result := queryName(t, s, "ntuity_unknown", now, now.Add(time.Hour)); len(result) != 0 {
+		t.Errorf("got %+v for unknown metric, want none", result)
+	}
+}
+
+func TestLocalStorageTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+
+	s, err := openLocalStorage(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.append(now.Add(time.Duration(i)*time.Minute), []*dto.MetricFamily{gaugeFamily("ntuity_power_grid", "a", float64(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut off the last sample record as a crash while writing it would.
+	segments, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("got segments %v (%v), want one", segments, err)
+	}
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segments[0], info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openLocalStorage(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.append(now.Add(2*time.Minute), []*dto.MetricFamily{gaugeFamily("ntuity_power_grid", "a", 2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := queryName(t, s, "ntuity_power_grid", now, now.Add(time.Hour))
+	want := []tsdbSample{{millis(now), 0}, {millis(now.Add(2 * time.Minute)), 2}}
+	if len(result) != 1 || !reflect.DeepEqual(result[0].samples, want) {
+		t.Errorf("got %+v, want samples %+v", result, want)
+	}
+}
+
+func TestLocalStorageRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Millisecond)
+
+	s, err := openLocalStorage(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	for _, ts := range []time.Time{now.Add(-2 * time.Hour), now.Add(-time.Minute)} {
+		if err := s.append(ts, []*dto.MetricFamily{gaugeFamily("ntuity_power_grid", "a", 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := queryName(t, s, "ntuity_power_grid", now.Add(-3*time.Hour), now)
+	if len(result) != 1 || len(result[0].samples) != 1 || result[0].samples[0].t != millis(now.Add(-time.Minute)) {
+		t.Errorf("got %+v, want only the sample within the retention period", result)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// weatherURL is the Open-Meteo forecast endpoint returning the current
+// weather at a location.
+const weatherURL = "https://api.open-meteo.com/v1/forecast?latitude=%g&longitude=%g&current=temperature_2m,shortwave_radiation"
+
+// weatherRefreshInterval is the interval in which the weather at a site is
+// retrieved. Open-Meteo updates the current weather every 15 minutes.
+const weatherRefreshInterval = 15 * time.Minute
+
+// weatherMaxAge is the age up to which the last retrieved weather is used
+// while retrieving it fails.
+const weatherMaxAge = time.Hour
+
+var weatherClient = &http.Client{Timeout: 10 * time.Second}
+
+// LocationConfig is the location of a site used to retrieve the weather.
+type LocationConfig struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (l *LocationConfig) validate() error {
+	if l.Latitude < -90 || l.Latitude > 90 {
+		return fmt.Errorf("latitude %v not between -90 and 90", l.Latitude)
+	}
+	if l.Longitude < -180 || l.Longitude > 180 {
+		return fmt.Errorf("longitude %v not between -180 and 180", l.Longitude)
+	}
+	return nil
+}
+
+// Weather is the current weather returned by Open-Meteo.
+type Weather struct {
+	Current struct {
+		Temperature float64 `json:"temperature_2m"`
+		// Irradiance is the global horizontal irradiance in W/m², averaged
+		// over the preceding 15 minutes.
+		Irradiance float64 `json:"shortwave_radiation"`
+	} `json:"current"`
+}
+
+func retrieveWeather(location *LocationConfig) (*Weather, error) {
+	res, err := weatherClient.Get(fmt.Sprintf(weatherURL, location.Latitude, location.Longitude))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %d", res.StatusCode)
+	}
+
+	var weather Weather
+	if err := json.NewDecoder(res.Body).Decode(&weather); err != nil {
+		return nil, err
+	}
+
+	return &weather, nil
+}
+
+// defaultHeatingBaseTemperature is the outdoor temperature in °C below which
+// buildings are assumed to be heated.
+const defaultHeatingBaseTemperature = 15
+
+// siteWeather holds the irradiation integrated from the irradiance at a site
+// and the heating degree days integrated from the temperature.
+type siteWeather struct {
+	powerIntegrator
+	Day              string  `json:"day"`
+	IrradiationToday float64 `json:"irradiation_today"`
+	Month            string  `json:"month"`
+	DegreeDays       float64 `json:"degree_days"`
+	DegreeDaysToday  float64 `json:"degree_days_today"`
+	DegreeDaysMonth  float64 `json:"degree_days_month"`
+
+	current     *Weather
+	updated     time.Time
+	lastRefresh time.Time
+}
+
+// weatherTracker retrieves the weather at each site with a configured
+// location and integrates the irradiance into the irradiation of the day.
+type weatherTracker struct {
+	mu     sync.Mutex
+	sites  map[string]*siteWeather
+	config *configStore
+
+	temperature *prometheus.GaugeVec
+	irradiance  *prometheus.GaugeVec
+	irradiation *prometheus.GaugeVec
+}
+
+func newWeatherTracker(reg *prometheus.Registry, config *configStore) *weatherTracker {
+	w := &weatherTracker{
+		sites:  make(map[string]*siteWeather),
+		config: config,
+		temperature: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "weather_temperature_celsius",
+				Help:      "Current air temperature in °C at the site",
+			},
+			[]string{"site"},
+		),
+		irradiance: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "weather_irradiance_w_per_m2",
+				Help:      "Current global horizontal irradiance in W/m² at the site",
+			},
+			[]string{"site"},
+		),
+		irradiation: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "ntuity",
+				Name:      "weather_irradiation_today_wh_per_m2",
+				Help:      "Global horizontal irradiation in Wh/m² at the site since midnight",
+			},
+			[]string{"site"},
+		),
+	}
+
+	reg.MustRegister(w.temperature, w.irradiance, w.irradiation)
+
+	config.onRemoveSite(func(site string) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.sites, site)
+		w.temperature.DeleteLabelValues(site)
+		w.irradiance.DeleteLabelValues(site)
+		w.irradiation.DeleteLabelValues(site)
+	})
+
+	return w
+}
+
+func (w *weatherTracker) observe(site string, flow *EnergyFlow) {
+	siteConfig, ok := w.config.get().site(site)
+	if !ok || siteConfig.Location == nil {
+		return
+	}
+
+	w.mu.Lock()
+	s, ok := w.sites[site]
+	if !ok {
+		s = &siteWeather{}
+		w.sites[site] = s
+	}
+	refresh := time.Since(s.lastRefresh) >= weatherRefreshInterval
+	w.mu.Unlock()
+
+	// Don't block scrapes while waiting for Open-Meteo.
+	var current *Weather
+	if refresh {
+		var err error
+		current, err = retrieveWeather(siteConfig.Location)
+		if err != nil {
+			logError("Failed to retrieve weather for site %s: %v", site, err)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if refresh {
+		s.lastRefresh = time.Now()
+		if current != nil {
+			s.current = current
+			s.updated = s.lastRefresh
+		} else if time.Since(s.updated) > weatherMaxAge {
+			s.current = nil
+		}
+	}
+
+	if s.current == nil {
+		w.temperature.DeleteLabelValues(site)
+		w.irradiance.DeleteLabelValues(site)
+		return
+	}
+
+	w.temperature.WithLabelValues(site).Set(s.current.Current.Temperature)
+	w.irradiance.WithLabelValues(site).Set(s.current.Current.Irradiance)
+
+	base := float64(defaultHeatingBaseTemperature)
+	if siteConfig.HeatingBaseTemperature != nil {
+		base = *siteConfig.HeatingBaseTemperature
+	}
+
+	// The irradiance and the heating degrees are integrated along the samples
+	// of the site to match the energy counters.
+	t := flow.timestamp()
+	energy, fresh := s.step(t, map[string]float64{
+		"irradiance":      s.current.Current.Irradiance,
+		"heating_degrees": positive(base - s.current.Current.Temperature),
+	})
+	if !fresh {
+		return
+	}
+
+	local := t.In(siteConfig.timeLocation())
+	day := local.Format("2006-01-02")
+	if day != s.Day {
+		s.Day = day
+		s.IrradiationToday = 0
+		s.DegreeDaysToday = 0
+	}
+	month := local.Format("2006-01")
+	if month != s.Month {
+		s.Month = month
+		s.DegreeDaysMonth = 0
+	}
+
+	s.IrradiationToday += energy["irradiance"]
+
+	// The integrated heating degrees are in degree hours.
+	degreeDays := energy["heating_degrees"] / 24
+	s.DegreeDays += degreeDays
+	s.DegreeDaysToday += degreeDays
+	s.DegreeDaysMonth += degreeDays
+
+	w.irradiation.WithLabelValues(site).Set(s.IrradiationToday)
+}
+
+// irradiationToday returns the irradiation in Wh/m² at the site since
+// midnight. It returns false if the weather isn't retrieved for the site.
+func (w *weatherTracker) irradiationToday(site string) (float64, bool) {
+	now := time.Now().In(w.config.get().siteLocation(site))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s, ok := w.sites[site]
+	if !ok || s.current == nil {
+		return 0, false
+	}
+	if s.Day != now.Format("2006-01-02") {
+		return 0, true
+	}
+	return s.IrradiationToday, true
+}
+
+// degreeDays returns the heating degree days at the site in total, since
+// midnight and since the start of the month. It returns false if the weather
+// isn't retrieved for the site.
+func (w *weatherTracker) degreeDays(site string) (float64, float64, float64, bool) {
+	now := time.Now().In(w.config.get().siteLocation(site))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s, ok := w.sites[site]
+	if !ok || s.current == nil {
+		return 0, 0, 0, false
+	}
+
+	today, month := s.DegreeDaysToday, s.DegreeDaysMonth
+	if s.Day != now.Format("2006-01-02") {
+		today = 0
+	}
+	if s.Month != now.Format("2006-01") {
+		month = 0
+	}
+	return s.DegreeDays, today, month, true
+}
+
+func (w *weatherTracker) saveState(s *state) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s.Weather = make(map[string]*siteWeather)
+	for site, weather := range w.sites {
+		copied := &siteWeather{
+			powerIntegrator:  weather.powerIntegrator,
+			Day:              weather.Day,
+			IrradiationToday: weather.IrradiationToday,
+			Month:            weather.Month,
+			DegreeDays:       weather.DegreeDays,
+			DegreeDaysToday:  weather.DegreeDaysToday,
+			DegreeDaysMonth:  weather.DegreeDaysMonth,
+		}
+		copied.LastPower = copyValues(weather.LastPower)
+		s.Weather[site] = copied
+	}
+}
+
+func (w *weatherTracker) restoreState(s *state) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cfg := w.config.get()
+	for site, weather := range s.Weather {
+		if !cfg.hasSite(site) {
+			continue
+		}
+		w.sites[site] = weather
+	}
+}